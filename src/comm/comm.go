@@ -11,18 +11,28 @@ import (
     "os"
     "io"
     "encoding/binary"
-    "bytes"
     "fmt"
+    "sort"
     .   "core"
+    "login"
     "protocol"
+    "util"
     "goprotobuf.googlecode.com/hg/proto"
 )
 
 const (
-    ProtocolVersion = 1
+    ProtocolVersion    = 4 // Newest protocol version spoken by the server
+    MinProtocolVersion = 1 // Oldest protocol version still accepted
+
+    batchVersion   = 2 // Clients speaking at least this version get Batch messages
+    terrainVersion = 3 // Clients speaking at least this version get Terrain messages
 
     lengthBytes = 2                      // Number of bytes to store protobuf length
-    maxMsgSize  = 1<<(8*lengthBytes) - 1 // 2^(8 * lengthBytes)
+    maxMsgSize  = 1<<(8*lengthBytes) - 1 // 2^(8 * lengthBytes), without varint framing
+
+    // Most bytes a Terrain message and the Batch around it take besides
+    // cells and type names
+    terrainOverhead = 64
 )
 
 var byteOrder = binary.LittleEndian
@@ -30,6 +40,11 @@ var byteOrder = binary.LittleEndian
 var AvatarFunc func(ServiceContext, chan *protocol.Message) (chan Msg,
 UniqueId) = dummyAvatarFunc
 
+// Static terrain of the world, sent to every client once it's started, in
+// several pieces if it is too big for a single message. Nothing is sent if
+// nil. Must be set before the comm service is started.
+var Terrain *MsgTerrain
+
 // addClient and removeClient are internal messages for manipulating the list
 // of clients in a thread safe way
 type addClientMsg struct {
@@ -41,6 +56,24 @@ type removeClientMsg struct {
     reason string
 }
 
+// Input from a client, in deterministic mode it is kept until the next tick.
+type inputMsg struct {
+    cl  *client
+    msg *protocol.Message
+}
+
+// Tells a client's send loop to write msg, which must be a Disconnect, after
+// anything still pending and then stop sending.
+type disconnectMsg struct {
+    msg *protocol.Message
+}
+
+// What clients are connected through. This is a net.Conn for real clients,
+// but anything that can be read, written and closed will do, e.g. for replays.
+type Transport interface {
+    io.ReadWriteCloser
+}
+
 type CommService struct {
     *HandlerQueue
     svc      ServiceContext
@@ -48,24 +81,73 @@ type CommService struct {
     address  string
     listener chan bool
     input    chan Msg
+    // Whether Run was called before. The listener and replay keep going when
+    // the service is restarted after a crash, so they are only started once.
+    started bool
+    // Number given to the last client started, in deterministic mode
+    nextId uint32
+    // Client input is written here if not nil, see Record
+    recorder *recorder
+    // Clients come from here instead of the network if not nil, see Replay
+    replay *Replay
 }
 
 func (cs *CommService) Chan() chan Msg { return cs.input }
 
 func NewCommService(svc ServiceContext, address string) *CommService {
     hq := NewHandlerQueue()
-    ch := make(chan bool)
-    return &CommService{hq, svc, make([]*client, 0, 5), address, ch, nil}
+    ch := make(chan bool, 1) // Buffered in case listening already failed
+    return &CommService{hq, svc, make([]*client, 0, 5), address, ch, nil,
+        false, 0, nil, nil}
+}
+
+// Records the input of every client to filename, so that the session can be
+// replayed later. Only works in deterministic mode and must be called before
+// Run.
+func (cs *CommService) Record(filename string) os.Error {
+    if !cs.svc.Deterministic {
+        return os.NewError("Recording needs deterministic mode")
+    }
+    r, err := newRecorder(filename, cs.svc.Seed)
+    if err != nil {
+        return err
+    }
+    cs.recorder = r
+    return nil
+}
+
+// Replays a recorded session instead of listening for clients. The
+// ServiceContext must be deterministic and use the seed of the replay. Game is
+// told to quit once the replay is over. Must be called before Run.
+func (cs *CommService) Replay(r *Replay) {
+    cs.replay = r
 }
 
 func (cs *CommService) Run(input chan Msg) {
     cs.input = input
-    go listen(cs.svc, input, "tcp", cs.address, cs.listener)
+    if !cs.started {
+        cs.started = true
+        if cs.replay == nil {
+            go listen(cs.svc, input, "tcp", cs.address, cs.listener)
+        } else {
+            cs.replay.prepare(cs, 1) // Ticks start at 1
+        }
+    }
 
-    Send(cs, cs.svc.Game, MsgTick{input}) // Service is ready
+    Send(cs, cs.svc.Game, MsgTick{Origin: input}) // Service is ready
 
     for {
-        cs.handle(cs.GetMsg(input))
+        msg := cs.GetMsg(input)
+        if m, ok := msg.(MsgQuit); ok {
+            cs.listener <- true   // Stop listening first so we don't
+            cs.removeAllClients() // add any more clients
+            if cs.recorder != nil {
+                cs.recorder.close()
+            }
+            AckQuit(cs, m)
+            return
+        }
+        cs.handle(msg)
     }
 }
 
@@ -73,28 +155,171 @@ func (cs *CommService) handle(msg Msg) {
     switch m := msg.(type) {
     case addClientMsg:
         cs.clients = append(cs.clients, m.cl)
-        log.Println(m.cl.name, "connected")
+        if m.cl.started {
+            logConnected(m.cl)
+        } else if cs.replay != nil {
+            m.cl.id = replayId(m.cl)
+        }
+    case inputMsg:
+        m.cl.pending = append(m.cl.pending, m.msg)
     case removeClientMsg:
-        cs.removeClient(m.cl, m.reason)
-    case MsgQuit:
-        cs.listener <- true   // Stop listening first so we don't
-        cs.removeAllClients() // add any more clients
-        return
+        if cs.svc.Deterministic { // Removed at the next tick
+            if !m.cl.removed {
+                m.cl.removed, m.cl.removeReason = true, m.reason
+            }
+        } else {
+            cs.removeClient(m.cl, m.reason)
+        }
     case MsgTick: // Client state should be updated
+        if cs.svc.Deterministic {
+            cs.handOver(m.Tick)
+        }
         for _, cl := range cs.clients {
             cl.observer <- m
         }
+        if cs.svc.Deterministic { // Game waits for the input to be handed over
+            Send(cs, m.Origin, MsgTick{Origin: cs.input})
+        }
     }
 }
 
+func logConnected(cl *client) {
+    log.Printf("%s connected (protocol %d, client %q)", cl.name, cl.version,
+        cl.versionStr)
+}
+
+// Hands over everything that happened since the last tick: new clients are
+// started, input is passed on to the avatars and disconnected clients are
+// removed, each in a fixed order and recorded if recording. Only used in
+// deterministic mode, where this happens at the end of every tick.
+func (cs *CommService) handOver(tick uint64) {
+    if cs.replay != nil && !cs.replay.done {
+        cs.waitForReplay(tick)
+    }
+
+    // In replay mode clients start in the recorded order, otherwise in the
+    // order they connected
+    var waiting, started []*client
+    for _, cl := range cs.clients {
+        if !cl.started {
+            waiting = append(waiting, cl)
+        }
+    }
+    if cs.replay != nil {
+        sort.Sort(byId(waiting))
+    }
+    for _, cl := range waiting {
+        if cl.removed {
+            continue // Gone before it got started
+        }
+        cs.nextId++
+        if cl.id == 0 {
+            cl.id = cs.nextId
+        }
+        cs.record(tick, cl, wrapConnect(cl.connect))
+        cs.record(tick, cl, wrapLogin(cl.login))
+        cl.start(cs.svc, cs.input)
+        logConnected(cl)
+    }
+
+    for _, cl := range cs.clients {
+        if cl.started {
+            started = append(started, cl)
+        }
+    }
+    sort.Sort(byId(started))
+    for _, cl := range started {
+        disconnected := false
+        for _, msg := range cl.pending {
+            cs.record(tick, cl, msg)
+            if *msg.Type == protocol.Message_Type(protocol.Message_DISCONNECT) {
+                disconnected = true
+                cl.removed = true
+                cl.removeReason = proto.GetString(msg.Disconnect.ReasonStr)
+            } else if cl.avatar != nil {
+                cl.RecvQueue <- msg // Forward to avatar
+            }
+        }
+        cl.pending = nil
+        if cl.removed {
+            if !disconnected { // Replays need to know when it was gone
+                cs.record(tick, cl, makeDisconnect(protocol.Disconnect_QUIT,
+                    cl.removeReason))
+            }
+            continue
+        }
+        if cl.avatar != nil {
+            // Avatar passes the input on to its entity
+            reply := make(chan Msg)
+            Send(cs, cl.avatar, MsgTick{Origin: reply})
+            Recv(cs, reply)
+        }
+    }
+    for _, cl := range append(waiting, started...) {
+        if cl.removed {
+            cs.removeClient(cl, cl.removeReason)
+        }
+    }
+
+    if cs.recorder != nil {
+        cs.recorder.flush()
+    }
+    if cs.replay != nil {
+        cs.replay.prepare(cs, tick+1)
+    }
+}
+
+// Waits until everything recorded for tick has arrived. Gives up on the replay
+// if a recorded client is missing. A MsgQuit ends the wait, it is handled once
+// the tick is over.
+func (cs *CommService) waitForReplay(tick uint64) {
+    for {
+        ready, missing := cs.replay.ready(cs.clients, tick)
+        if ready {
+            return
+        } else if missing != 0 {
+            cs.replay.abort(cs, fmt.Sprintf("client %d is missing at tick %d",
+                missing, tick))
+            return
+        }
+        msg := cs.GetMsg(cs.input)
+        if _, ok := msg.(MsgQuit); ok {
+            cs.HandleMsg(msg)
+            return
+        }
+        cs.handle(msg)
+    }
+}
+
+func (cs *CommService) record(tick uint64, cl *client, msg *protocol.Message) {
+    if cs.recorder != nil {
+        cs.recorder.record(tick, cl.id, msg)
+    }
+}
+
+// Sorts clients by id
+type byId []*client
+
+func (l byId) Len() int           { return len(l) }
+func (l byId) Less(i, j int) bool { return l[i].id < l[j].id }
+func (l byId) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Tells every client that the server is shutting down and disconnects them.
 func (cs *CommService) removeAllClients() {
     log.Println("Shutting down server")
-    for _, cl := range cs.clients {
-        cs.removeClient(cl, "")
+    disconnect := makeDisconnect(protocol.Disconnect_QUIT, "Server shutting down")
+    for len(cs.clients) > 0 {
+        cs.disconnectClient(cs.clients[0], "", disconnect)
     }
 }
 
 func (cs *CommService) removeClient(cl *client, reason string) {
+    cs.disconnectClient(cl, reason, nil)
+}
+
+// Removes the client, sending it disconnect first if that is not nil.
+func (cs *CommService) disconnectClient(cl *client, reason string,
+disconnect *protocol.Message) {
     found := false
     for i, cur := range cs.clients {
         if cl == cur {
@@ -112,7 +337,8 @@ func (cs *CommService) removeClient(cl *client, reason string) {
         reason = ": " + reason
     }
     log.Println(cl.name, "disconnected"+reason)
-    cl.Quit()
+    cl.Quit(disconnect)
+    Send(cs, cs.svc.Login, login.MsgLogout{cl.name})
 }
 
 func listen(svc ServiceContext, cs chan<- Msg, protocol string, address string,
@@ -151,90 +377,142 @@ shutdown chan bool) {
     }
 }
 
-func connect(svc ServiceContext, cs chan<- Msg, conn net.Conn) {
+func connect(svc ServiceContext, cs chan<- Msg, conn Transport) {
     defer logAndClose(conn)
 
     // Read connect message
-    conn.SetReadTimeout(1e9) // 1s
-    msg := readMessageOrPanic(conn)
-    if msg.Connect == nil {
-        panic("Connect message not received!")
+    if nc, ok := conn.(net.Conn); ok {
+        nc.SetReadTimeout(1e9) // 1s
     }
+    msg := readMessageOrPanic(conn, fixedFraming)
+    if *msg.Type != protocol.Message_Type(protocol.Message_CONNECT) ||
+        msg.Connect == nil {
+        refuse(conn, fixedFraming, protocol.Disconnect_PROTOCOL_ERROR,
+            "Expected Connect message, got "+messageTypeName(msg))
+    }
+    connect := msg.Connect
 
     // Check protocol version
-    if *msg.Connect.Version != ProtocolVersion {
-        // TODO: Send a wrong protocol message, for now just close
-        panic(fmt.Sprintf("Wrong protocol version %d, needed %d",
-            *msg.Connect.Version, ProtocolVersion))
+    version := *connect.Version
+    if version < MinProtocolVersion || version > ProtocolVersion {
+        refuse(conn, fixedFraming, protocol.Disconnect_WRONG_PROTOCOL_VERSION,
+            fmt.Sprintf("Protocol version %d not supported, supported versions: %d-%d",
+                version, MinProtocolVersion, ProtocolVersion))
     }
 
-    // Send connect reply
-    msg = makeConnect()
-    sendMessageOrPanic(conn, msg)
+    // Send connect reply, the client's version is the one that will be spoken.
+    // Everything after the Connect messages uses the negotiated framing.
+    f, err := negotiateFraming(connect)
+    if err != nil {
+        refuse(conn, fixedFraming, protocol.Disconnect_PROTOCOL_ERROR,
+            err.String())
+    }
+    msg = makeConnect(version, f)
+    sendMessageOrPanic(conn, msg, fixedFraming)
 
     // Read login message
-    msg = readMessageOrPanic(conn)
-    if msg.Login == nil {
-        panic("Login message not received!")
+    msg = readMessageOrPanic(conn, f)
+    if *msg.Type != protocol.Message_Type(protocol.Message_LOGIN) ||
+        msg.Login == nil {
+        refuse(conn, f, protocol.Disconnect_PROTOCOL_ERROR,
+            "Expected Login message, got "+messageTypeName(msg))
     }
     login := msg.Login
-    logged_in, reason := startLogin(login)
+    logged_in, reason := startLogin(svc, login)
+    // The comm service logs the client out once it has it, until then any
+    // failure has to free the account here so it doesn't stay locked
+    handedOver := false
+    if logged_in {
+        defer func() {
+            if !handedOver {
+                logout(svc, *login.Name)
+            }
+        }()
+    }
 
     // Send login reply
     msg = makeLoginResult(logged_in, reason)
-    sendMessageOrPanic(conn, msg)
+    sendMessageOrPanic(conn, msg, f)
+    if !logged_in {
+        log.Println(*login.Name, "failed to log in:",
+            protocol.LoginResult_Reason_name[reason])
+        conn.Close()
+        return
+    }
 
-    cl := newClient(svc, cs, conn, login)
+    cl := newClient(svc, cs, conn, f, connect, login)
+    if !svc.Deterministic { // Otherwise started at the next tick
+        cl.start(svc, cs)
+    }
     cs <- addClientMsg{cl}
+    handedOver = true
+}
+
+// Tells the peer why the handshake failed with a Disconnect message, then
+// panics so that logAndClose logs the reason and closes the connection.
+func refuse(conn Transport, f *framing, reason int32, reason_str string) {
+    sendMessage(conn, makeDisconnect(reason, reason_str), f) // Best effort
+    panic(reason_str)
+}
+
+// Returns the printable type of a message
+func messageTypeName(msg *protocol.Message) string {
+    return protocol.Message_Type_name[int32(*msg.Type)]
 }
 
 // Recovers from fatal errors, logs them, and closes the connection
-func logAndClose(conn net.Conn) {
+func logAndClose(conn Transport) {
     if e := recover(); e != nil {
         log.Println(e)
         conn.Close()
     }
 }
 
-func sendMessageOrPanic(w io.Writer, msg *protocol.Message) {
-    err := sendMessage(w, msg)
+func sendMessageOrPanic(w io.Writer, msg *protocol.Message, f *framing) {
+    err := sendMessage(w, msg, f)
     if err != nil {
         panic(err.String())
     }
 }
 
-func readMessageOrPanic(r io.Reader) *protocol.Message {
-    msg, err := readMessage(r)
+func readMessageOrPanic(r io.Reader, f *framing) *protocol.Message {
+    msg, err := readMessage(r, f)
     if err != nil {
         panic(err.String())
     }
     return msg
 }
 
-func sendMessage(w io.Writer, msg *protocol.Message) os.Error {
-    // Marshal protobuf
-    bs, err := proto.Marshal(msg)
+func sendMessage(w io.Writer, msg *protocol.Message, f *framing) os.Error {
+    bs, err := frameMessage(msg, f)
     if err != nil {
         return err
     }
+    return writeAll(w, bs)
+}
 
-    // Send pb
-    if bs, err = prependByteLength(bs); err != nil {
-        return err
+// Marshals the message and prepends its length
+func frameMessage(msg *protocol.Message, f *framing) ([]byte, os.Error) {
+    bs, err := proto.Marshal(msg)
+    if err != nil {
+        return nil, err
     }
+    return prependByteLength(bs, f)
+}
+
+func writeAll(w io.Writer, bs []byte) os.Error {
     if n, err := w.Write(bs); err != nil {
         return err
     } else if n != len(bs) {
         return os.NewError(fmt.Sprintf("Wrote only %d bytes out of %d bytes!", n, len(bs)))
     }
-
     return nil
 }
 
-func readMessage(r io.Reader) (msg *protocol.Message, err os.Error) {
+func readMessage(r io.Reader, f *framing) (msg *protocol.Message, err os.Error) {
 start:
     // Read length
-    length, err := readLength(r)
+    length, err := readLength(r, f)
     if err != nil {
         if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
             // Socket timed out on read, read again
@@ -247,7 +525,7 @@ start:
     // Read the message bytes
     bs := make([]byte, length)
     if n, err := io.ReadFull(r, bs); err != nil {
-        log.Println("Error reading message bytes:", err)
+        return nil, err
     } else if n != len(bs) {
         return nil, os.NewError(fmt.Sprintf("Read only %d bytes out of expected %d bytes!", n, length))
     }
@@ -260,34 +538,19 @@ start:
     return msg, nil
 }
 
-// Reads the length of a message
-func readLength(r io.Reader) (length uint16, err os.Error) {
-    err = binary.Read(r, byteOrder, &length)
-    return
-}
-
-// Prepends the length of the passed byte array to the array.
-// Returns error if byte array is too large.
-func prependByteLength(data []byte) ([]byte, os.Error) {
-    data_len := len(data)
-    if data_len > maxMsgSize {
-        return nil, os.NewError("Message size exceeds maxMsgSize")
-    }
-    length := uint16(data_len)
-
-    buf := new(bytes.Buffer)
-    err := binary.Write(buf, byteOrder, length)
-    if err != nil {
-        return nil, os.NewError(fmt.Sprintf("Binary conversion error: %s", err))
-    }
-    data = append(buf.Bytes(), data...)
-    return data, nil
+// Initiates a login with the login service and returns the result of the
+// login attempt
+func startLogin(svc ServiceContext, msg *protocol.Login) (bool, int32) {
+    reply := make(chan Msg)
+    svc.Login <- login.MsgLogin{*msg.Name, proto.GetString(msg.Authtoken), reply}
+    result := (<-reply).(login.MsgLoginResult)
+    return result.Succeeded, result.Reason
 }
 
-// Initiates a login and returns the result of the login attempt
-func startLogin(msg *protocol.Login) (bool, int32) {
-    // TODO: Talk to login service
-    return true, protocol.LoginResult_ACCEPTED // Logins are still always accepted ;(
+// Frees the account of a client that logged in but never made it to the comm
+// service.
+func logout(svc ServiceContext, name string) {
+    svc.Login <- login.MsgLogout{name}
 }
 
 // Represents remote client. Contains queue of messages to send and permission
@@ -295,8 +558,14 @@ func startLogin(msg *protocol.Login) (bool, int32) {
 type client struct {
     // Name of client or player name
     name string
+    // Protocol version agreed on during the handshake
+    version uint32
+    // Client software version, as sent in Connect.version_str
+    versionStr string
+    // How messages to and from the client are delimited
+    framing *framing
     // conn transport to client
-    conn net.Conn
+    conn Transport
     // Permission set mask
     permissions uint32
     // Queue of messages to be sent to client. observer fills this channel.
@@ -310,46 +579,134 @@ type client struct {
     observer chan Msg
     // Control channel for avatar
     avatar chan Msg
+    // Closed once SendLoop has stopped writing to conn
+    sendDone chan bool
+    // True once the avatar and observer have been created, see start
+    started bool
+
+    // The rest is only used in deterministic mode, by the comm service.
+
+    // Number of the client in recordings, given in the order clients start
+    id uint32
+    // Handshake messages, kept for recording
+    connect *protocol.Connect
+    login   *protocol.Login
+    // Input received since the last tick
+    pending []*protocol.Message
+    // Set when the client is to be removed at the next tick
+    removed      bool
+    removeReason string
 }
 
-// Create a new client and start up send/receive goroutines.
-func newClient(svc ServiceContext, cs chan<- Msg, conn net.Conn,
-l *protocol.Login) *client {
-    send_ch := make(chan Msg)
-    recv_ch := make(chan *protocol.Message)
-    obs := createObserver(svc, send_ch)
-    avatar, uid := AvatarFunc(svc, recv_ch)
+// Create a new client and start up its receive goroutine. Nothing is sent to
+// the client until start is called.
+func newClient(svc ServiceContext, cs chan<- Msg, conn Transport, f *framing,
+c *protocol.Connect, l *protocol.Login) *client {
     cl := &client{
         name:        *l.Name,
+        version:     *c.Version,
+        versionStr:  proto.GetString(c.VersionStr),
+        framing:     f,
         permissions: proto.GetUint32(l.Permissions),
         conn:        conn,
-        SendQueue:   send_ch,
-        RecvQueue:   recv_ch,
-        observer:    obs,
-        avatar:      avatar,
+        SendQueue:   make(chan Msg),
+        RecvQueue:   make(chan *protocol.Message),
+        sendDone:    make(chan bool),
+        connect:     c,
+        login:       l,
+    }
+    go cl.RecvLoop(svc, cs)
+    return cl
+}
+
+// Creates the avatar and observer of the client and starts sending to it.
+func (cl *client) start(svc ServiceContext, cs chan<- Msg) {
+    avatar, uid := AvatarFunc(svc, cl.RecvQueue)
+    // Without a real avatar the uid is just a dummy, see below
+    var controlled UniqueId
+    if avatar != nil {
+        controlled = uid
     }
-    go cl.RecvLoop(cs)
+    cl.avatar = avatar
+    cl.started = true
     go cl.SendLoop(cs)
+    // Terrain is queued before the observer adds any entities
+    if Terrain != nil && cl.version >= terrainVersion {
+        for _, piece := range splitTerrain(*Terrain, cl.framing) {
+            cl.SendQueue <- piece
+        }
+    }
+    cl.observer = createObserver(svc, cl.SendQueue, controlled)
 
     // Only attempt to assign control if a real avatar channel was returned,
     // otherwise the uid is just a dummy and should not be sent. This mostly
     // applies to tests.
     if avatar != nil {
-        send_ch <- MsgAssignControl{uid, false}
+        cl.SendQueue <- MsgAssignControl{uid, false}
     }
-    return cl
 }
 
-// Receives messages from remote client and acts upon them if appropriate.
-func (cl *client) RecvLoop(cs chan<- Msg) {
+// Splits terrain into rectangles small enough to each be sent in a single
+// message with framing f, row by row and for very wide maps also column by
+// column.
+func splitTerrain(t MsgTerrain, f *framing) []MsgTerrain {
+    budget := f.maxSize - terrainOverhead // Bytes left for cells
+    for _, name := range t.Types {
+        budget -= len(name) + 2
+    }
+    width := t.Width
+    if width > budget {
+        width = budget
+    }
+    if width < 1 {
+        width = 1
+    }
+    height := budget / width
+    if height < 1 {
+        height = 1
+    }
+
+    var pieces []MsgTerrain
+    for y := 0; y < t.Height; y += height {
+        for x := 0; x < t.Width; x += width {
+            w, h := width, height
+            if x+w > t.Width {
+                w = t.Width - x
+            }
+            if y+h > t.Height {
+                h = t.Height - y
+            }
+            cells := make([]byte, 0, w*h)
+            for row := y; row < y+h; row++ {
+                start := row*t.Width + x
+                cells = append(cells, t.Cells[start:start+w]...)
+            }
+            pieces = append(pieces, MsgTerrain{t.X + x, t.Y + y, w, h, cells,
+                t.Types})
+        }
+    }
+    return pieces
+}
+
+// Receives messages from remote client and acts upon them if appropriate. In
+// deterministic mode everything goes to the comm service instead, which hands
+// it over at the next tick.
+func (cl *client) RecvLoop(svc ServiceContext, cs chan<- Msg) {
     defer logAndClose(cl.conn)
     for {
-        msg, err := readMessage(cl.conn)
+        msg, err := readMessage(cl.conn, cl.framing)
         if err != nil {
             // Remove client if something went wrong
             cs <- removeClientMsg{cl, "Reading message from client failed: " + err.String()}
             return
         }
+        if svc.Deterministic {
+            cs <- inputMsg{cl, msg}
+            if *msg.Type == protocol.Message_Type(protocol.Message_DISCONNECT) {
+                return
+            }
+            continue
+        }
         switch *msg.Type {
         case protocol.Message_Type(protocol.Message_DISCONNECT):
             cs <- removeClientMsg{cl, proto.GetString(msg.Disconnect.ReasonStr)}
@@ -362,47 +719,148 @@ func (cl *client) RecvLoop(cs chan<- Msg) {
     }
 }
 
-// Sends messages over the remote conn that come through the queue.
+// Sends messages over the remote conn that come through the queue. Messages
+// are collected until the observer signals the end of a tick and then written
+// out all at once.
 func (cl *client) SendLoop(cs chan<- Msg) {
     defer logAndClose(cl.conn)
+    err, quit := cl.send()
+    close(cl.sendDone)
+    if err != nil {
+        // Remove client if something went wrong. The comm service may be busy
+        // removing this client already, so don't wait on it.
+        reason := "Sending message to client failed: " + err.String()
+        go func() { cs <- removeClientMsg{cl, reason} }()
+    }
+    if !quit {
+        // Keep the observer from blocking until it quits
+        util.DrainUntilQuit(cl.SendQueue)
+    }
+}
+
+// Does the work of SendLoop. Returns when a write fails, a disconnect has been
+// sent or the observer has quit, in which case quit is true.
+func (cl *client) send() (err os.Error, quit bool) {
+    batch := make([]*protocol.Message, 0, 16) // Messages for the current tick
     for {
         msg := <-cl.SendQueue
-        var err os.Error
+        var out *protocol.Message
         switch m := msg.(type) {
+        case msgFlush:
+            err = cl.flush(m.tick, batch)
+            batch = batch[:0]
+            if err != nil {
+                return err, false
+            }
+            continue
+        case disconnectMsg:
+            // Whatever is pending goes out first, it is all the same tick
+            if err = cl.flush(0, batch); err != nil {
+                return err, false
+            }
+            return sendMessage(cl.conn, m.msg, cl.framing), false
+        case MsgQuit:
+            return nil, true
         case MsgAddEntity:
-            err = sendMessage(cl.conn, makeAddEntity(int32(m.Uid), m.Name))
+            out = makeAddEntity(int32(m.Uid), m.Name)
         case MsgRemoveEntity:
-            err = sendMessage(cl.conn, makeRemoveEntity(int32(m.Uid), m.Name))
+            out = makeRemoveEntity(int32(m.Uid), m.Name)
         case MsgUpdateState:
-            value := packState(m.State)
-            err = sendMessage(cl.conn, makeUpdateState(int32(m.Uid), m.State.Name(), value))
+            value, perr := packState(m.State)
+            if perr != nil {
+                log.Printf("Not sending state %s of %d: %v", m.State.Name(),
+                    m.Uid, perr)
+                continue
+            }
+            out = makeUpdateState(int32(m.Uid), m.State.Name(), value)
+        case MsgStateRemoved:
+            out = makeRemoveState(int32(m.Uid), m.Name)
         case MsgAssignControl:
-            err = sendMessage(cl.conn, makeAssignControl(int32(m.Uid), m.Revoked))
+            out = makeAssignControl(int32(m.Uid), m.Revoked)
         case MsgEntityDeath:
             uid, name := m.Entity.Uid, m.Entity.Name
             kuid, kname := m.Killer.Uid, m.Killer.Name
-            err = sendMessage(cl.conn, makeEntityDeath(int32(uid), name, int32(kuid), kname))
+            out = makeEntityDeath(int32(uid), name, int32(kuid), kname)
+        case MsgTerrain:
+            out = makeTerrain(int32(m.X), int32(m.Y), uint32(m.Width),
+                uint32(m.Height), m.Cells, m.Types)
         case MsgCombatHit:
             auid, aname := m.Attacker.Uid, m.Attacker.Name
             vuid, vname := m.Victim.Uid, m.Victim.Name
-            err = sendMessage(cl.conn, makeCombatHit(int32(auid), aname, int32(vuid), vname, m.Damage))
+            out = makeCombatHit(int32(auid), aname, int32(vuid), vname,
+                m.Damage, int32(m.Outcome))
+        default:
+            continue
         }
-        // Remove client if something went wrong
-        if err != nil {
-            cs <- removeClientMsg{cl, "Sending message to client failed: " + err.String()}
-            return
+        batch = append(batch, out)
+    }
+}
+
+// Writes the messages of a tick to the client with a single write. Clients
+// that understand batches get them wrapped in Batch messages, older clients
+// get each message framed on its own.
+func (cl *client) flush(tick uint32, msgs []*protocol.Message) os.Error {
+    if len(msgs) == 0 {
+        return nil
+    }
+    var bs []byte
+    if cl.version >= batchVersion {
+        var err os.Error
+        if bs, err = frameBatch(tick, msgs, cl.framing); err != nil {
+            return err
+        }
+    } else {
+        for _, msg := range msgs {
+            frame, err := frameMessage(msg, cl.framing)
+            if err != nil {
+                return err
+            }
+            bs = append(bs, frame...)
         }
     }
+    return writeAll(cl.conn, bs)
+}
+
+// Frames the messages as one Batch, or as several if they do not fit in a
+// single frame.
+func frameBatch(tick uint32, msgs []*protocol.Message, f *framing) ([]byte, os.Error) {
+    bs, err := frameMessage(makeBatch(tick, msgs), f)
+    if err == nil || len(msgs) == 1 {
+        return bs, err
+    }
+    half := len(msgs) / 2
+    if bs, err = frameBatch(tick, msgs[:half], f); err != nil {
+        return nil, err
+    }
+    rest, err := frameBatch(tick, msgs[half:], f)
+    if err != nil {
+        return nil, err
+    }
+    return append(bs, rest...), nil
 }
 
-// Disconnects client and closes all client resources.
-func (cl *client) Quit() {
+// Disconnects client and closes all client resources. If disconnect is not
+// nil, it is sent to the client before the connection is closed.
+func (cl *client) Quit(disconnect *protocol.Message) {
+    if disconnect != nil && !cl.started {
+        sendMessage(cl.conn, disconnect, cl.framing) // Nothing else is sending
+    } else if disconnect != nil {
+        select {
+        case cl.SendQueue <- disconnectMsg{disconnect}:
+            <-cl.sendDone // Wait until it has been written
+        case <-cl.sendDone: // Nothing is being sent anymore
+        }
+    }
     cl.conn.Close()
 
     // Close this client's observer and avatar
     quit := MsgQuit{}
-    cl.observer <- quit
-    cl.avatar <- quit
+    if cl.observer != nil {
+        cl.observer <- quit
+    }
+    if cl.avatar != nil {
+        cl.avatar <- quit
+    }
 }
 
 // Return default values to satisfy tests, if returned chan is used, will cause
@@ -6,13 +6,21 @@ package comm
 
 import (
     "testing"
+    "bytes"
     "net"
     "time"
     .   "core"
     "game"
+    "login"
     "protocol"
     "pubsub"
     "util"
+    "goprotobuf.googlecode.com/hg/proto"
+)
+
+const (
+    testName     = "TestPlayer"
+    testPassword = "passwordHash"
 )
 
 // Starts the server with a default ServiceContext for tests that don't need it
@@ -33,6 +41,11 @@ ctx ServiceContext) (svc *CommService, cs chan Msg) {
     go game.NewGame(ctx).Run(ctx.Game)
     go pubsub.NewPubSub(ctx).Run(ctx.PubSub)
 
+    // Only the test account may log in
+    accounts := login.NewAccountStore()
+    accounts.Add(testName, testPassword)
+    go login.NewLoginService(ctx, accounts, 0).Run(ctx.Login)
+
     // Give time for the service to start listening
     time.Sleep(1e8) // 100 ms
     return svc, cs
@@ -62,11 +75,11 @@ func connectClient(t *testing.T, fd net.Conn) {
     }()
 
     // Create protocol buffer to initiate connection
-    connect := makeConnect()
-    sendMessageOrPanic(fd, connect)
+    connect := makeConnect(ProtocolVersion, fixedFraming)
+    sendMessageOrPanic(fd, connect, fixedFraming)
 
     failure = "Connect message not received"
-    msg := readMessageOrPanic(fd)
+    msg := readMessageOrPanic(fd, fixedFraming)
     if msg.Connect == nil {
         t.Fatalf(failure)
     }
@@ -78,21 +91,32 @@ func connectClient(t *testing.T, fd net.Conn) {
         t.Error("Version strings do not match")
     }
 
-    // Send login message
-    failure = "Error sending login message"
-    login := makeLogin("TestPlayer", "passwordHash", 0)
-    sendMessageOrPanic(fd, login)
+    result := loginClient(t, fd, fixedFraming, testName, testPassword)
+    if *result.Succeeded != true {
+        t.Fatalf("Login failed!")
+    }
+}
+
+// Sends a login message and returns the server's reply
+func loginClient(t *testing.T, fd net.Conn, f *framing, name,
+password string) *protocol.LoginResult {
+    failure := "Error sending login message"
+    defer func() {
+        if e := recover(); e != nil {
+            t.Fatalf("%s: %v", failure, e)
+            fd.Close()
+        }
+    }()
+    login := makeLogin(name, password, 0)
+    sendMessageOrPanic(fd, login, f)
 
     // Read login result message
     failure = "Login result message not received"
-    msg = readMessageOrPanic(fd)
+    msg := readMessageOrPanic(fd, f)
     if msg.LoginResult == nil {
         t.Fatalf(failure)
     }
-    result := msg.LoginResult
-    if *result.Succeeded != true {
-        t.Fatalf("Login failed!")
-    }
+    return msg.LoginResult
 }
 
 // Tests the connection handshake
@@ -117,7 +141,7 @@ func TestConnect(t *testing.T) {
         }
     }()
     disconnect := makeDisconnect(protocol.Disconnect_QUIT, "Test finished")
-    sendMessageOrPanic(fd, disconnect)
+    sendMessageOrPanic(fd, disconnect, fixedFraming)
 
     fd.Close()
 
@@ -130,8 +154,13 @@ func TestServerQuit(t *testing.T) {
     fd := newTestClient(t)
     connectClient(t, fd)
 
-    cs <- MsgQuit{}
-    time.Sleep(1e7) // Block thread 10ms to let the server respond
+    reply := make(chan Msg)
+    cs <- MsgQuit{reply}
+    // Client is told about the shutdown before being disconnected
+    verifyDisconnect(t, fd, protocol.Disconnect_QUIT)
+    if _, ok := (<-reply).(MsgQuit); !ok {
+        t.Fatalf("Quit not acknowledged")
+    }
     if len(svc.clients) > 0 {
         t.Fatalf("Client not removed from server list")
     }
@@ -162,3 +191,196 @@ func TestServerQuit(t *testing.T) {
 
     time.Sleep(1e8) // Wait 100ms to make sure we can't connect
 }
+
+// Tests that a wrong password is refused and the connection closed
+func TestLoginDenied(t *testing.T) {
+    _, cs := startServer(t)
+    defer func() { cs <- MsgQuit{} }()
+    fd := newTestClient(t)
+    defer fd.Close()
+
+    sendMessageOrPanic(fd, makeConnect(ProtocolVersion, fixedFraming), fixedFraming)
+    if msg := readMessageOrPanic(fd, fixedFraming); msg.Connect == nil {
+        t.Fatalf("Connect message not received")
+    }
+
+    result := loginClient(t, fd, fixedFraming, testName, "wrong password")
+    if *result.Succeeded {
+        t.Fatalf("Login with wrong password succeeded")
+    }
+    if *result.Reason != protocol.LoginResult_ACCESS_DENIED {
+        t.Errorf("Expected ACCESS_DENIED, got %v", *result.Reason)
+    }
+    if _, err := readMessage(fd, fixedFraming); err == nil {
+        t.Errorf("Connection not closed after failed login")
+    }
+}
+
+// Tests that an unsupported protocol version is refused with a reason
+func TestWrongProtocolVersion(t *testing.T) {
+    _, cs := startServer(t)
+    defer func() { cs <- MsgQuit{} }()
+    fd := newTestClient(t)
+    defer fd.Close()
+
+    sendMessageOrPanic(fd, makeConnect(ProtocolVersion+1, fixedFraming), fixedFraming)
+    verifyDisconnect(t, fd, protocol.Disconnect_WRONG_PROTOCOL_VERSION)
+}
+
+// Tests that skipping the Connect message is refused as a protocol error
+func TestHandshakeProtocolError(t *testing.T) {
+    _, cs := startServer(t)
+    defer func() { cs <- MsgQuit{} }()
+    fd := newTestClient(t)
+    defer fd.Close()
+
+    sendMessageOrPanic(fd, makeLogin(testName, testPassword, 0), fixedFraming)
+    verifyDisconnect(t, fd, protocol.Disconnect_PROTOCOL_ERROR)
+}
+
+// Reads a Disconnect with the expected reason, then expects the connection to
+// be closed
+func verifyDisconnect(t *testing.T, fd net.Conn, reason int32) {
+    msg, err := readMessage(fd, fixedFraming)
+    if err != nil {
+        t.Fatalf("No disconnect received: %v", err)
+    }
+    if msg.Disconnect == nil {
+        t.Fatalf("Expected Disconnect, got %s", messageTypeName(msg))
+    }
+    if int32(*msg.Disconnect.Reason) != reason {
+        t.Errorf("Wrong disconnect reason %v, expected %v",
+            *msg.Disconnect.Reason, reason)
+    }
+    if msg.Disconnect.ReasonStr == nil {
+        t.Errorf("Disconnect has no reason string")
+    }
+    if _, err := readMessage(fd, fixedFraming); err == nil {
+        t.Errorf("Connection not closed after disconnect")
+    }
+}
+
+// Tests that a client asking for varint framing gets it after the Connect
+// messages, with the smaller of the two size limits
+func TestVarintFraming(t *testing.T) {
+    _, cs := startServer(t)
+    defer func() { cs <- MsgQuit{} }()
+    fd := newTestClient(t)
+    defer fd.Close()
+
+    want := &framing{true, 4096}
+    sendMessageOrPanic(fd, makeConnect(ProtocolVersion, want), fixedFraming)
+    reply := readMessageOrPanic(fd, fixedFraming).Connect
+    if reply == nil {
+        t.Fatalf("Connect message not received")
+    }
+    if *reply.Framing != protocol.Connect_Framing(protocol.Connect_VARINT) {
+        t.Fatalf("Server did not agree to varint framing")
+    }
+    if int(*reply.MaxMessageSize) != want.maxSize {
+        t.Errorf("Wrong maximum message size %d, expected %d",
+            *reply.MaxMessageSize, want.maxSize)
+    }
+
+    result := loginClient(t, fd, want, testName, testPassword)
+    if !*result.Succeeded {
+        t.Fatalf("Login failed!")
+    }
+}
+
+var framingTests = []struct {
+    framing *protocol.Connect_Framing
+    maxSize *uint32
+    want    *framing // nil if the client is refused
+}{
+    {nil, nil, fixedFraming},
+    {protocol.NewConnect_Framing(protocol.Connect_FIXED16), proto.Uint32(10),
+        fixedFraming},
+    {protocol.NewConnect_Framing(protocol.Connect_VARINT), nil,
+        &framing{true, MaxMessageSize}},
+    {protocol.NewConnect_Framing(protocol.Connect_VARINT), proto.Uint32(0),
+        &framing{true, MaxMessageSize}},
+    {protocol.NewConnect_Framing(protocol.Connect_VARINT), proto.Uint32(5000),
+        &framing{true, 5000}},
+    {protocol.NewConnect_Framing(protocol.Connect_VARINT), proto.Uint32(1 << 30),
+        &framing{true, MaxMessageSize}},
+    {protocol.NewConnect_Framing(protocol.Connect_VARINT),
+        proto.Uint32(minMessageSize - 1), nil},
+}
+
+func TestNegotiateFraming(t *testing.T) {
+    for i, test := range framingTests {
+        connect := &protocol.Connect{Version: proto.Uint32(ProtocolVersion),
+            Framing: test.framing, MaxMessageSize: test.maxSize}
+        f, err := negotiateFraming(connect)
+        if test.want == nil {
+            if err == nil {
+                t.Errorf("%d: framing %v accepted", i, f)
+            }
+        } else if err != nil || f.varint != test.want.varint ||
+            f.maxSize != test.want.maxSize {
+            t.Errorf("%d: framing %v (%v), expected %v", i, f, err, test.want)
+        }
+    }
+}
+
+// Oversized lengths must be rejected without reading the message
+func TestOversizedLength(t *testing.T) {
+    f := &framing{true, 100}
+    buf := bytes.NewBuffer(append(proto.EncodeVarint(1<<40), 0))
+    if _, err := readMessage(buf, f); err == nil {
+        t.Errorf("Oversized varint length accepted")
+    }
+    if _, err := prependByteLength(make([]byte, 101), f); err == nil {
+        t.Errorf("Oversized message framed")
+    }
+    if _, err := prependByteLength(make([]byte, maxMsgSize+1), fixedFraming); err == nil {
+        t.Errorf("Oversized message framed with fixed length")
+    }
+
+    // Round trip a message that is too big for the fixed length prefix
+    big := &framing{true, 1 << 20}
+    bs, err := prependByteLength(make([]byte, maxMsgSize+1), big)
+    if err != nil {
+        t.Fatalf("Could not frame large message: %v", err)
+    }
+    length, err := readLength(bytes.NewBuffer(bs), big)
+    if err != nil || length != maxMsgSize+1 {
+        t.Errorf("Read length %d (%v), expected %d", length, err, maxMsgSize+1)
+    }
+}
+
+// Terrain too big for a message is sent in pieces that fit and cover it all
+func TestSplitTerrain(t *testing.T) {
+    const width, height = 300, 200
+    terrain := MsgTerrain{-5, 10, width, height, make([]byte, width*height),
+        []string{"Ground", "Wall"}}
+    for i := range terrain.Cells {
+        terrain.Cells[i] = byte(i % 2)
+    }
+
+    for _, f := range []*framing{fixedFraming, &framing{true, 200}} {
+        covered := make([]byte, width*height)
+        for _, p := range splitTerrain(terrain, f) {
+            msg := makeTerrain(int32(p.X), int32(p.Y), uint32(p.Width),
+                uint32(p.Height), p.Cells, p.Types)
+            if _, err := frameBatch(1, []*protocol.Message{msg}, f); err != nil {
+                t.Fatalf("Piece does not fit in a message: %v", err)
+            }
+            if len(p.Cells) != p.Width*p.Height {
+                t.Fatalf("Piece has %d cells, expected %d", len(p.Cells),
+                    p.Width*p.Height)
+            }
+            for i, c := range p.Cells {
+                x, y := p.X-terrain.X+i%p.Width, p.Y-terrain.Y+i/p.Width
+                covered[y*width+x] = c + 1
+            }
+        }
+        for i, c := range covered {
+            if c != terrain.Cells[i]+1 {
+                t.Fatalf("Cell %d not covered correctly with max size %d", i,
+                    f.maxSize)
+            }
+        }
+    }
+}
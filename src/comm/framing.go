@@ -0,0 +1,123 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package comm
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "protocol"
+    "goprotobuf.googlecode.com/hg/proto"
+)
+
+// Largest message that will be sent or accepted with varint framing. A client
+// may ask for a smaller limit during the handshake, but never a larger one.
+var MaxMessageSize = 1 << 20 // 1 MiB
+
+// Describes how messages are delimited on the wire. Every message is prefixed
+// by its length, either in lengthBytes little endian bytes or as a varint.
+type framing struct {
+    varint  bool // If true, the length prefix is a varint
+    maxSize int  // Largest message sent or accepted
+}
+
+// Framing used for the Connect messages and for any client that does not ask
+// for something else.
+var fixedFraming = &framing{false, maxMsgSize}
+
+// Smallest maximum message size a client may ask for. Anything less could not
+// even hold a piece of the terrain.
+const minMessageSize = 1 << 12 // 4 KiB
+
+// Picks the framing used after the handshake based on what the client asked
+// for in its Connect message. A maximum message size of 0 counts as unset,
+// one below minMessageSize is refused.
+func negotiateFraming(connect *protocol.Connect) (*framing, os.Error) {
+    if connect.Framing == nil ||
+        *connect.Framing != protocol.Connect_Framing(protocol.Connect_VARINT) {
+        return fixedFraming, nil
+    }
+    size := MaxMessageSize
+    if connect.MaxMessageSize != nil && *connect.MaxMessageSize != 0 {
+        asked := int(*connect.MaxMessageSize)
+        if asked < minMessageSize {
+            return nil, os.NewError(fmt.Sprintf(
+                "Maximum message size %d too small, must be at least %d",
+                asked, minMessageSize))
+        }
+        if asked < size {
+            size = asked
+        }
+    }
+    return &framing{true, size}, nil
+}
+
+// Reads the length of a message. Lengths larger than the framing allows are
+// rejected before anything is allocated for the message.
+func readLength(r io.Reader, f *framing) (length int, err os.Error) {
+    if f.varint {
+        var l uint64
+        if l, err = readVarint(r); err != nil {
+            return 0, err
+        }
+        if l > uint64(f.maxSize) {
+            return 0, sizeError(l, f)
+        }
+        return int(l), nil
+    }
+
+    var l uint16
+    if err = binary.Read(r, byteOrder, &l); err != nil {
+        return 0, err
+    }
+    if int(l) > f.maxSize {
+        return 0, sizeError(uint64(l), f)
+    }
+    return int(l), nil
+}
+
+// Reads a protobuf style varint one byte at a time so that nothing past the
+// length prefix is consumed.
+func readVarint(r io.Reader) (uint64, os.Error) {
+    var x uint64
+    b := make([]byte, 1)
+    for shift := uint(0); shift < 64; shift += 7 {
+        if _, err := io.ReadFull(r, b); err != nil {
+            return 0, err
+        }
+        x |= uint64(b[0]&0x7f) << shift
+        if b[0] < 0x80 {
+            return x, nil
+        }
+    }
+    return 0, os.NewError("Message length varint is too long")
+}
+
+// Prepends the length of the passed byte array to the array.
+// Returns error if byte array is too large for the framing.
+func prependByteLength(data []byte, f *framing) ([]byte, os.Error) {
+    data_len := len(data)
+    if data_len > f.maxSize {
+        return nil, sizeError(uint64(data_len), f)
+    }
+    if f.varint {
+        return append(proto.EncodeVarint(uint64(data_len)), data...), nil
+    }
+
+    buf := new(bytes.Buffer)
+    err := binary.Write(buf, byteOrder, uint16(data_len))
+    if err != nil {
+        return nil, os.NewError(fmt.Sprintf("Binary conversion error: %s", err))
+    }
+    data = append(buf.Bytes(), data...)
+    return data, nil
+}
+
+func sizeError(size uint64, f *framing) os.Error {
+    return os.NewError(fmt.Sprintf("Message size %d exceeds maximum of %d",
+        size, f.maxSize))
+}
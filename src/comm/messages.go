@@ -9,8 +9,14 @@ import (
     "goprotobuf.googlecode.com/hg/proto"
 )
 
-func makeConnect() (msg *protocol.Message) {
-    connect := &protocol.Connect{Version: proto.Uint32(ProtocolVersion)}
+func makeConnect(version uint32, f *framing) (msg *protocol.Message) {
+    connect := &protocol.Connect{Version: proto.Uint32(version)}
+    if f.varint {
+        connect.Framing = protocol.NewConnect_Framing(protocol.Connect_VARINT)
+        connect.MaxMessageSize = proto.Uint32(uint32(f.maxSize))
+    } else {
+        connect.Framing = protocol.NewConnect_Framing(protocol.Connect_FIXED16)
+    }
 
     return &protocol.Message{
         Connect: connect,
@@ -93,6 +99,19 @@ func makeUpdateState(id int32, stateId string, value *protocol.StateValue) (msg
     }
 }
 
+func makeRemoveState(id int32, stateId string) (msg *protocol.Message) {
+    updateState := &protocol.UpdateState{
+        Id:      proto.Int32(id),
+        StateId: proto.String(stateId),
+        Removed: proto.Bool(true),
+    }
+
+    return &protocol.Message{
+        UpdateState: updateState,
+        Type:        protocol.NewMessage_Type(protocol.Message_UPDATESTATE),
+    }
+}
+
 func makeAssignControl(uid int32, revoked bool) (msg *protocol.Message) {
     ctrl := &protocol.AssignControl{
         Uid:     &uid,
@@ -119,13 +138,14 @@ func makeEntityDeath(uid int32, name string, kuid int32, kname string) (msg *pro
     }
 }
 
-func makeCombatHit(auid int32, aname string, vuid int32, vname string, damage float32) (msg *protocol.Message) {
+func makeCombatHit(auid int32, aname string, vuid int32, vname string, damage float32, outcome int32) (msg *protocol.Message) {
     combatHit := &protocol.CombatHit{
         AttackerUid:  &auid,
         AttackerName: &aname,
         VictimUid:    &vuid,
         VictimName:   &vname,
         Damage:       &damage,
+        Outcome:      protocol.NewCombatHit_Outcome(protocol.CombatHit_Outcome(outcome)),
     }
 
     return &protocol.Message{
@@ -133,3 +153,31 @@ func makeCombatHit(auid int32, aname string, vuid int32, vname string, damage fl
         Type:      protocol.NewMessage_Type(protocol.Message_COMBATHIT),
     }
 }
+
+func makeTerrain(x, y int32, width, height uint32, cells []byte, types []string) (msg *protocol.Message) {
+    terrain := &protocol.Terrain{
+        X:      &x,
+        Y:      &y,
+        Width:  &width,
+        Height: &height,
+        Cells:  cells,
+        Types:  types,
+    }
+
+    return &protocol.Message{
+        Terrain: terrain,
+        Type:    protocol.NewMessage_Type(protocol.Message_TERRAIN),
+    }
+}
+
+func makeBatch(tick uint32, msgs []*protocol.Message) (msg *protocol.Message) {
+    batch := &protocol.Batch{
+        Tick:     proto.Uint32(tick),
+        Messages: msgs,
+    }
+
+    return &protocol.Message{
+        Batch: batch,
+        Type:  protocol.NewMessage_Type(protocol.Message_BATCH),
+    }
+}
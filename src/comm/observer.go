@@ -11,7 +11,6 @@ package comm
 
 import (
     "fmt"
-    "reflect"
     "runtime"
     .   "core"
     "pubsub"
@@ -38,167 +37,402 @@ type MsgUpdateState struct {
     State State // Contains Name and Value needed for protocol
 }
 
+// Signal that a state has been removed from an entity on a client
+type MsgStateRemoved struct {
+    Uid  UniqueId
+    Name string // Name of the removed state
+}
+
+// Signals that all updates for a tick have been queued and may be written out
+// to the client.
+type msgFlush struct {
+    tick uint32
+}
+
+// Entities farther than this from the entity a client controls are not
+// replicated to that client. Zero or less disables the filtering. While it is
+// enabled, entities that have no position in the world are never replicated.
+var InterestRadius float64 = 40
+
+// If true, entities within InterestRadius are only replicated while the
+// controlled entity can see them, as answered by MsgVisibleEntities.
+var HideUnseen = false
+
 // Replicates data to a connected client. Views are created for each replicated entity.
 // This keeps the game state on the client in sync with the server.
+//
+// Once the client controls an entity, only entities within InterestRadius of
+// it are replicated. Views are created and removed as entities come into and
+// go out of range, or into and out of sight with HideUnseen.
 type observer struct {
+    // Holds messages that arrive while waiting on views
+    *HandlerQueue
     svc ServiceContext
     // The client on whose behalf this observer replicates
     client chan Msg
-    // Maps the entity to its view's control channel
-    // TODO: Store by Uid, not chan?
-    views map[chan Msg]chan Msg
+    // Entity controlled by the client, zero if none
+    controlled UniqueId
+    // Maps each replicated entity to its view
+    views map[UniqueId]*viewHandle
+    // Entities removed from the game that World may not know about yet
+    removed map[UniqueId]bool
+    // Views report here with their entity's uid once they have sent all
+    // updates for a tick
+    done chan UniqueId
     // Channel to control this observer
     ctrl chan Msg
+    // Set once a quit is queued, services aren't waited on anymore
+    quitting bool
 }
 
-// Creates an observer instance in a new goroutine and returns a control channel
-func createObserver(svc ServiceContext, client chan Msg) chan Msg {
+// What the observer keeps of each running view
+type viewHandle struct {
+    ent  *EntityDesc // The replicated entity
+    ctrl chan Msg    // Control channel of the view
+}
+
+// Creates an observer instance in a new goroutine and returns a control
+// channel. controlled is the uid of the entity the client controls, or zero.
+func createObserver(svc ServiceContext, client chan Msg,
+controlled UniqueId) chan Msg {
     // Create struct
-    obs := &observer{svc, client, make(map[chan Msg]chan Msg), make(chan Msg)}
+    obs := &observer{NewHandlerQueue(), svc, client, controlled,
+        make(map[UniqueId]*viewHandle), make(map[UniqueId]bool),
+        make(chan UniqueId), make(chan Msg), false}
     go obs.observe()
     return obs.ctrl
 }
 
-// Do initial observer set up
-func (obs *observer) init() {
-    // Get list of entities for initial sync
-    reply := make(chan Msg)
-    obs.svc.Game <- MsgListEntities{Reply: reply}
-    list, ok := (<-reply).(MsgListEntities)
-    if !ok {
-        panic("Request received incorrect reply")
-    }
-    for _, ent := range list.Entities {
-        if checkBlacklist(ent.Id) {
-            continue
+// Do initial observer set up. Returns false if the observer was told to quit
+// meanwhile, the quit is then queued.
+func (obs *observer) init() bool {
+    if obs.filtering() {
+        if !obs.updateInterest() {
+            return false
+        }
+    } else {
+        // Get list of entities for initial sync
+        reply := make(chan Msg, 1)
+        msg, ok := obs.request(obs.svc.Game, MsgListEntities{Reply: reply}, reply)
+        if !ok {
+            return false
+        }
+        list, ok := msg.(MsgListEntities)
+        if !ok {
+            panic("Request received incorrect reply")
+        }
+        for _, ent := range list.Entities {
+            if checkBlacklist(ent.Id) {
+                continue
+            }
+            obs.addView(ent)
         }
-        obs.addView(ent)
     }
     obs.svc.PubSub <- pubsub.SubscribeMsg{"entity", obs.ctrl}
     obs.svc.PubSub <- pubsub.SubscribeMsg{"combat", obs.ctrl}
+    return true
+}
+
+// Sends req to a service and waits for the reply on reply, which should be
+// buffered. Control messages are queued meanwhile. Returns false without
+// waiting any longer if one of them is a quit, as the service may never
+// answer, e.g. Game while it shuts down.
+func (obs *observer) request(service chan Msg, req Msg, reply chan Msg) (Msg, bool) {
+    for sent := false; !sent && !obs.quitting; {
+        select {
+        case service <- req:
+            sent = true
+        case m := <-obs.ctrl:
+            obs.queue(m)
+        }
+    }
+    for !obs.quitting {
+        select {
+        case m := <-reply:
+            return m, true
+        case m := <-obs.ctrl:
+            obs.queue(m)
+        }
+    }
+    return nil, false
+}
+
+// Queues a control message to be handled later, noting if it is a quit
+func (obs *observer) queue(msg Msg) {
+    if _, ok := msg.(MsgQuit); ok {
+        obs.quitting = true
+    }
+    obs.HandleMsg(msg)
 }
 
 func (obs *observer) observe() {
-    obs.init()
+    subscribed := obs.init()
     for {
-        msg := <-obs.ctrl
+        msg := obs.GetMsg(obs.ctrl)
         switch m := msg.(type) {
         case MsgTick: // Pass update msg to views
-            for _, v := range obs.views {
-                v <- msg
+            if !obs.quitting && obs.updateInterest() {
+                obs.tick(m)
             }
         case MsgQuit: // Client has disconnected, shut everything down
-            // Views may have pending updates, drain and discard
-            go util.DrainUntilQuit(obs.client)
+            // Views may have pending updates, the client's send loop
+            // discards them until it gets quit msg
             for _, v := range obs.views {
-                v <- msg
+                v.ctrl <- msg
             }
-            // Close the drain now that all views have gotten quit msg
+            // Now that all views have gotten quit msg, so can the client
             obs.client <- msg
+            if subscribed {
+                // PubSub may be publishing to us right now, keep draining
+                // so it can get to the unsubscribes
+                go util.Drain(obs.ctrl)
+                obs.svc.PubSub <- pubsub.UnsubscribeMsg{"entity", obs.ctrl}
+                obs.svc.PubSub <- pubsub.UnsubscribeMsg{"combat", obs.ctrl}
+            }
             return
         case MsgEntityAdded:
             ent := m.Entity
-            if checkBlacklist(ent.Id) {
+            // When filtering, new entities are picked up on the next tick
+            // if they are close enough
+            if checkBlacklist(ent.Id) || obs.filtering() {
                 continue
             }
-            if _, present := obs.views[ent.Chan]; present {
+            if _, present := obs.views[ent.Uid]; present {
                 str := "Duplicate MsgEntityAdded received, entity already has view:\n"
                 str = fmt.Sprint(str, ent.Uid, " ", ent.Name)
                 panic(str)
             }
             obs.addView(ent)
         case MsgEntityRemoved:
-            ent := m.Entity
-            // Signal quit to the correct view
-            if ch, ok := obs.views[ent.Chan]; ok {
-                ch <- MsgQuit{}
-            } else {
-                str := "Tried to remove an unadded entity:\n"
-                str = fmt.Sprint(str, ent.Uid, " ", ent.Name)
-                panic(str)
-            }
-            obs.views[ent.Chan] = nil, false
-            obs.client <- MsgRemoveEntity{ent.Uid, ent.Name}
+            obs.entityRemoved(m.Entity)
         default:
             obs.eventListener(m)
         }
     }
 }
 
+// Whether replication is limited to the entities near the controlled one
+func (obs *observer) filtering() bool {
+    return obs.controlled != 0 && InterestRadius > 0
+}
+
+// Asks the world which entities are near the controlled entity, then adds
+// views for those that came into range and removes those that left it. World
+// learns about removals on its own schedule, so entities this observer knows
+// to be removed are ignored until World stops listing them. Returns false if
+// the observer was told to quit meanwhile.
+func (obs *observer) updateInterest() bool {
+    if !obs.filtering() {
+        return true
+    }
+    reply := make(chan Msg, 1)
+    var req Msg = MsgEntitiesInRadius{obs.controlled, InterestRadius, reply}
+    if HideUnseen {
+        req = MsgVisibleEntities{obs.controlled, InterestRadius, reply}
+    }
+    msg, ok := obs.request(obs.svc.World, req, reply)
+    if !ok {
+        return false
+    }
+    list, ok := msg.(MsgListEntities)
+    if !ok {
+        panic("Request received incorrect reply")
+    }
+
+    near := make(map[UniqueId]*EntityDesc, len(list.Entities))
+    listed := make(map[UniqueId]bool, len(obs.removed))
+    for _, ent := range list.Entities {
+        if obs.removed[ent.Uid] {
+            listed[ent.Uid] = true
+            continue
+        }
+        if !checkBlacklist(ent.Id) {
+            near[ent.Uid] = ent
+        }
+    }
+    obs.removed = listed // World has caught up with the others
+    for uid, v := range obs.views {
+        if _, ok := near[uid]; !ok {
+            obs.removeView(v.ent)
+        }
+    }
+    for uid, ent := range near {
+        if _, ok := obs.views[uid]; !ok {
+            obs.addView(ent)
+        }
+    }
+    return true
+}
+
+// Passes the tick on to every view and waits until they have all queued their
+// updates, then tells the client to flush them. Entity removals are handled
+// right away as a view may be waiting on an entity that no longer exists. A
+// quit ends the wait, as a view may be waiting on an entity that never
+// answers. Any other message is queued until the tick is done.
+func (obs *observer) tick(msg MsgTick) {
+    pending := make(map[UniqueId]bool, len(obs.views))
+    for uid, v := range obs.views {
+        v.ctrl <- msg // Views always take control messages
+        pending[uid] = true
+    }
+
+    for len(pending) > 0 {
+        select {
+        case uid := <-obs.done:
+            pending[uid] = false, false
+        case m := <-obs.ctrl:
+            switch m := m.(type) {
+            case MsgEntityRemoved:
+                obs.entityRemoved(m.Entity)
+                pending[m.Entity.Uid] = false, false
+            case MsgQuit: // Nothing is flushed anymore
+                obs.queue(m)
+                return
+            default:
+                obs.queue(m)
+            }
+        }
+    }
+    obs.client <- msgFlush{uint32(msg.Tick)}
+}
+
+// Handles the removal of an entity from the game
+func (obs *observer) entityRemoved(ent *EntityDesc) {
+    if obs.filtering() {
+        obs.removed[ent.Uid] = true
+    }
+    if _, ok := obs.views[ent.Uid]; !ok {
+        if obs.filtering() {
+            return // Was out of range, nothing to remove
+        }
+        str := "Tried to remove an unadded entity:\n"
+        str = fmt.Sprint(str, ent.Uid, " ", ent.Name)
+        panic(str)
+    }
+    obs.removeView(ent)
+}
+
 // Creates a new view and starts it replicating
 func (obs *observer) addView(ent *EntityDesc) {
     obs.client <- MsgAddEntity{ent.Uid, ent.Name}
-    v := &view{client: obs.client, entity: ent.Chan}
+    owner := ent.Uid == obs.controlled
+    v := &view{client: obs.client, entity: ent.Chan, owner: owner}
     v_ch := make(chan Msg)
-    obs.views[ent.Chan] = v_ch
-    go v.replicate(ent.Uid, v_ch)
+    obs.views[ent.Uid] = &viewHandle{ent, v_ch}
+    go v.replicate(ent.Uid, v_ch, obs.done)
 }
 
-// Checks to see if this entity is blacklisted
-// Returns true if blacklisted, false otherwise
-func checkBlacklist(id EntityId) bool {
-    return false // TODO: Actually check
+// Stops the entity's view and removes the entity from the client
+func (obs *observer) removeView(ent *EntityDesc) {
+    obs.views[ent.Uid].ctrl <- MsgQuit{}
+    obs.views[ent.Uid] = nil, false
+    obs.client <- MsgRemoveEntity{ent.Uid, ent.Name}
 }
 
-// Replicates an individual entity. Each state of the watched entity is tracked
-// for changes. If the state has changed then an update is sent to the client.
+// Replicates an individual entity. Each tick the view asks the watched entity
+// for the states changed since the last tick and sends an update to the client
+// for each of them.
 type view struct {
-    client chan Msg
-    entity chan Msg
-    states StateList // Current value of each replicated state
+    client  chan Msg
+    entity  chan Msg
+    owner   bool      // True if the client controls the entity
+    states  StateList // Current value of each replicated state
+    version uint64    // Entity version the client is up to date with
 }
 
-func (v *view) replicate(uid UniqueId, ctrl chan Msg) {
-    // TODO: Eventually this list will fill with states that are no longer in
-    // the entity, we need a mechanism to clear it out occasionally
+func (v *view) replicate(uid UniqueId, ctrl chan Msg, done chan UniqueId) {
     v.states = make(StateList)
-    request := MsgGetAllStates{}
-    msg := MsgUpdateState{}
-    msg.Uid = uid
+    // Ticks that arrive during an update are covered by it, as it asks for
+    // the states after they arrived
+    covered := v.update(uid, ctrl) // Initial sync
 
     for {
-        reply := make(chan Msg)
-        request.Reply = reply
+        // Report that the updates for those ticks are queued. Ticks arriving
+        // meanwhile need another update.
+        ticks := 0
+        for ; covered > 0; covered-- {
+            ticks += v.report(uid, ctrl, done)
+        }
+        // Listen for next update signal
+        for ticks == 0 {
+            ticks = handleCtrl(<-ctrl)
+        }
+        covered = ticks + v.update(uid, ctrl)
+    }
+}
+
+// Sends the client an update for each state that changed or was removed since
+// the last call. The view keeps taking control messages while it waits on the
+// entity and returns the number of ticks among them.
+func (v *view) update(uid UniqueId, ctrl chan Msg) (ticks int) {
+    reply := make(chan Msg, 1) // The entity may answer after the view quit
+    request := MsgGetChangedStates{v.version, reply}
+    // Get changed states from entity and filter out those that are not
+    // whitelisted
+    for sent := false; !sent; {
         select {
-        // TODO: White or black list?
-        // Get whitelisted states from entity (must check for new states)
         case v.entity <- request:
+            sent = true
         case msg := <-ctrl:
-            handleCtrl(msg)
+            ticks += handleCtrl(msg)
         }
+    }
+    var changes MsgStateChanges
+    for received := false; !received; {
+        select {
+        case msg := <-reply:
+            changes, received = msg.(MsgStateChanges), true
+        case msg := <-ctrl:
+            ticks += handleCtrl(msg)
+        }
+    }
+    v.version = changes.Version
 
-        for m := range reply {
-            s := m.(State)
-            if !checkWhiteList(s.Id()) {
-                continue
-            }
-            // Compare to current value (first time will be none)
-            if val, ok := v.states[s.Id()]; ok {
-                if reflect.DeepEqual(val, s) {
-                    continue
-                }
-            }
-            v.states[s.Id()] = s
-            // Send updates for any changed states
-            msg.State = s
-            v.client <- msg
+    msg := MsgUpdateState{}
+    msg.Uid = uid
+    for _, s := range changes.States {
+        if !checkWhiteList(s.Id(), v.owner) {
+            continue
         }
-        // Listen for next update signal
-        msg := <-ctrl
-        handleCtrl(msg)
+        v.states[s.Id()] = s
+        // Send updates for any changed states
+        msg.State = s
+        v.client <- msg
     }
+    // Only states the client knows about need to be removed
+    for _, id := range changes.Removed {
+        if s, ok := v.states[id]; ok {
+            v.states[id] = nil, false
+            v.client <- MsgStateRemoved{uid, s.Name()}
+        }
+    }
+    return ticks
 }
 
-func handleCtrl(msg Msg) {
-    if _, ok := msg.(MsgQuit); ok {
-        runtime.Goexit()
+// Tells the observer that the updates for a tick are queued. Returns the
+// number of ticks that arrived meanwhile.
+func (v *view) report(uid UniqueId, ctrl chan Msg, done chan UniqueId) (ticks int) {
+    for {
+        select {
+        case done <- uid:
+            return ticks
+        case msg := <-ctrl:
+            ticks += handleCtrl(msg)
+        }
     }
+    return ticks // Never reached
 }
 
-// Checks to see if this entity is whitelisted
-// Returns true if whitelisted, false otherwise
-func checkWhiteList(id StateId) bool {
-    return true // TODO: Actually check
+// Ends the view on MsgQuit, otherwise returns 1 for a tick and 0 for anything
+// else.
+func handleCtrl(msg Msg) int {
+    switch msg.(type) {
+    case MsgQuit:
+        runtime.Goexit()
+    case MsgTick:
+        return 1
+    }
+    return 0
 }
 
 // Send events to client
@@ -9,6 +9,7 @@ import (
     "time"
     .   "core"
     "pubsub"
+    "util"
 )
 
 func InitTestEntity(uid UniqueId) Entity {
@@ -24,6 +25,10 @@ func (x testState) Name() string { return "TestState" }
 
 var nextUid UniqueId = 1
 
+func init() {
+    ReplicateState(testState{}.Id(), Everyone)
+}
+
 // Test replicating entity data through observers up through the initial sync.
 func TestObserver(t *testing.T) {
     svc := NewServiceContext()
@@ -31,7 +36,7 @@ func TestObserver(t *testing.T) {
     go gameEmulator(t, svc, ent.Chan(), ent)
     go pubsubEmulator(t, svc)
     client := make(chan Msg)
-    obs := createObserver(svc, client)
+    obs := createObserver(svc, client, 0)
 
     // Expecting one entity added
     verifyEntityAdded(t, client, ent)
@@ -48,6 +53,27 @@ func TestObserver(t *testing.T) {
     verifyEntityAdded(t, client, ent2)
     verifyStateUpdated(t, client, ent2)
 
+    // Nothing changed, tick should only produce a flush
+    obs <- MsgTick{Tick: 1}
+    verifyFlush(t, client, 1)
+
+    // Only the changed state is sent on the next tick
+    ent2.Chan() <- MsgSetState{testState{3}}
+    obs <- MsgTick{Tick: 2}
+    verifyStateUpdated(t, client, ent2)
+    verifyFlush(t, client, 2)
+
+    // Removed states are removed from the client too
+    ent2.Chan() <- MsgRemoveState{testState{}.Id()}
+    obs <- MsgTick{Tick: 3}
+    msg := getMessage(t, client)
+    if m, ok := msg.(MsgStateRemoved); !ok {
+        t.Fatalf("Expected state removal, got %v", msg)
+    } else if m.Uid != ent2.Uid() || m.Name != (testState{}).Name() {
+        t.Errorf("Wrong state removed: %v", m)
+    }
+    verifyFlush(t, client, 3)
+
     // Expecting entity removed
     rm_msg := MsgEntityRemoved{desc}
     svc.PubSub <- pubsub.PublishMsg{"entity", rm_msg}
@@ -56,6 +82,153 @@ func TestObserver(t *testing.T) {
     obs <- MsgQuit{}
 }
 
+// Test that only entities near the controlled one are replicated
+func TestInterest(t *testing.T) {
+    svc := NewServiceContext()
+    player := createTestEntity(svc, 1)
+    spider := createTestEntity(svc, 2)
+    go util.Drain(svc.PubSub)
+    nearby := make(chan []Entity)
+    go worldEmulator(t, svc, player, nearby)
+    client := make(chan Msg)
+    obs := createObserver(svc, client, player.Uid())
+
+    // Initially only the player is in range
+    nearby <- []Entity{player}
+    verifyEntityAdded(t, client, player)
+    verifyStateUpdated(t, client, player)
+
+    // Spider comes into range
+    obs <- MsgTick{Tick: 1}
+    nearby <- []Entity{player, spider}
+    verifyEntityAdded(t, client, spider)
+    verifyStateUpdated(t, client, spider)
+    verifyFlush(t, client, 1)
+
+    // And leaves it again
+    obs <- MsgTick{Tick: 2}
+    nearby <- []Entity{player}
+    verifyEntityRemoved(t, client, spider)
+    verifyFlush(t, client, 2)
+
+    // Spider is removed from the game while in range
+    obs <- MsgTick{Tick: 3}
+    nearby <- []Entity{player, spider}
+    verifyEntityAdded(t, client, spider)
+    verifyStateUpdated(t, client, spider)
+    verifyFlush(t, client, 3)
+    obs <- MsgEntityRemoved{NewEntityDesc(spider)}
+    verifyEntityRemoved(t, client, spider)
+    quit := make(chan Msg)
+    spider.Chan() <- MsgQuit{quit}
+    <-quit
+
+    // World has not heard of the removal yet, the spider stays removed
+    obs <- MsgTick{Tick: 4}
+    nearby <- []Entity{player, spider}
+    verifyFlush(t, client, 4)
+
+    obs <- MsgQuit{}
+}
+
+// A view that gets the tick before its entity answered the initial sync must
+// still send the states and report back
+func TestTickDuringSync(t *testing.T) {
+    svc := NewServiceContext()
+    player := createTestEntity(svc, 1)
+    go util.Drain(svc.PubSub)
+    nearby := make(chan []Entity)
+    go worldEmulator(t, svc, player, nearby)
+    client := make(chan Msg)
+    obs := createObserver(svc, client, player.Uid())
+    nearby <- []Entity{player}
+    verifyEntityAdded(t, client, player)
+    verifyStateUpdated(t, client, player)
+
+    // The spider is added and ticked in the same tick, but only starts
+    // answering once the tick has reached its view
+    spider := InitTestEntity(nextUid)
+    nextUid++
+    spider.SetState(testState{2})
+    obs <- MsgTick{Tick: 1}
+    nearby <- []Entity{player, spider}
+    verifyEntityAdded(t, client, spider)
+    time.Sleep(1e7) // 10 ms
+    go spider.Run(svc)
+    verifyStateUpdated(t, client, spider)
+    verifyFlush(t, client, 1)
+
+    // And the following ticks work as usual
+    spider.Chan() <- MsgSetState{testState{3}}
+    obs <- MsgTick{Tick: 2}
+    nearby <- []Entity{player, spider}
+    verifyStateUpdated(t, client, spider)
+    verifyFlush(t, client, 2)
+
+    obs <- MsgQuit{}
+}
+
+// An entity that never answers must not keep the observer from quitting
+func TestQuitDuringTick(t *testing.T) {
+    svc := NewServiceContext()
+    stuck := InitTestEntity(nextUid) // Never run
+    nextUid++
+    go gameEmulator(t, svc, stuck.Chan(), stuck)
+    go util.Drain(svc.PubSub)
+    client := make(chan Msg)
+    obs := createObserver(svc, client, 0)
+    verifyEntityAdded(t, client, stuck)
+
+    obs <- MsgTick{Tick: 1}
+    obs <- MsgQuit{}
+    if msg := getMessage(t, client); !isQuit(msg) {
+        t.Errorf("Expected quit, got %v", msg)
+    }
+}
+
+// Game does not answer while it shuts down, the observer must still quit
+func TestQuitDuringInit(t *testing.T) {
+    svc := NewServiceContext()
+    go util.Drain(svc.Game)
+    client := make(chan Msg)
+    obs := createObserver(svc, client, 0)
+    obs <- MsgTick{Tick: 1}
+    obs <- MsgQuit{}
+    if msg := getMessage(t, client); !isQuit(msg) {
+        t.Errorf("Expected quit, got %v", msg)
+    }
+}
+
+func TestReplicationPolicy(t *testing.T) {
+    const (
+        hidden    = 100
+        ownerOnly = 101
+        monster   = 100
+    )
+    // The declarations are global, leave them as they were for other tests
+    vis, declared := whitelist[ownerOnly]
+    blacklisted := blacklist[monster]
+    defer func() {
+        whitelist[ownerOnly] = vis, declared
+        blacklist[monster] = true, blacklisted
+    }()
+    ReplicateState(ownerOnly, OwnerOnly)
+    BlacklistEntity(monster)
+
+    if checkWhiteList(hidden, true) {
+        t.Errorf("Undeclared state replicated")
+    }
+    if !checkWhiteList(ownerOnly, true) || checkWhiteList(ownerOnly, false) {
+        t.Errorf("Owner only state not limited to owner")
+    }
+    if !checkWhiteList(testState{}.Id(), false) {
+        t.Errorf("State replicated to everyone not sent to non-owner")
+    }
+    if !checkBlacklist(monster) || checkBlacklist(monster+1) {
+        t.Errorf("Blacklist does not match declarations")
+    }
+}
+
 func TestDuplicateEntity(t *testing.T) {
     // TODO: Implement trying to add same entity twice (observer should panic)
 }
@@ -93,6 +266,15 @@ func verifyEntityRemoved(t *testing.T, client chan Msg, ent Entity) {
     }
 }
 
+func verifyFlush(t *testing.T, client chan Msg, tick uint32) {
+    msg := getMessage(t, client)
+    if m, ok := msg.(msgFlush); !ok {
+        t.Fatalf("Expected flush, got %v", msg)
+    } else if m.tick != tick {
+        t.Errorf("Flush for tick %d, expected %d", m.tick, tick)
+    }
+}
+
 func verifyStateUpdated(t *testing.T, client chan Msg, ent Entity) {
     msg := getMessage(t, client)
     if m, ok := msg.(MsgUpdateState); !ok {
@@ -114,6 +296,11 @@ func verifyStateUpdated(t *testing.T, client chan Msg, ent Entity) {
     }
 }
 
+func isQuit(msg Msg) bool {
+    _, ok := msg.(MsgQuit)
+    return ok
+}
+
 // Gets a message or times out with an error
 func getMessage(t *testing.T, ch chan Msg) Msg {
     select {
@@ -145,6 +332,27 @@ testEnt Entity) {
     list.Reply <- MsgListEntities{nil, desc}
 }
 
+// Masquerades as the world service, answering each radius query with the next
+// list of entities sent on nearby
+func worldEmulator(t *testing.T, svc ServiceContext, center Entity,
+nearby chan []Entity) {
+    for {
+        query, ok := (<-svc.World).(MsgEntitiesInRadius)
+        if !ok {
+            t.Fatal("Unexpected message sent to world service")
+        }
+        if query.Uid != center.Uid() {
+            t.Errorf("Query around %v, expected %v", query.Uid, center.Uid())
+        }
+        ents := <-nearby
+        list := make([]*EntityDesc, len(ents))
+        for i, ent := range ents {
+            list[i] = NewEntityDesc(ent)
+        }
+        query.Reply <- MsgListEntities{nil, list}
+    }
+}
+
 // Masquerades as a pubsub service for testing purposes
 func pubsubEmulator(t *testing.T, svc ServiceContext) {
     var obs chan Msg
@@ -0,0 +1,312 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package comm
+
+import (
+    "bufio"
+    "io"
+    "log"
+    "os"
+    "sync"
+    .   "core"
+    "protocol"
+    "util"
+    "goprotobuf.googlecode.com/hg/proto"
+)
+
+// A replay file is a ReplayHeader followed by ReplayEntry messages, each
+// prefixed by its length as a varint. Entries are written at the end of every
+// tick in deterministic mode, see CommService.handOver.
+var replayFraming = &framing{true, 1 << 24}
+
+// Writes client input to a replay file
+type recorder struct {
+    file *os.File
+    w    *bufio.Writer
+}
+
+func newRecorder(filename string, seed int64) (*recorder, os.Error) {
+    file, err := os.Open(filename, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+    if err != nil {
+        return nil, err
+    }
+    r := &recorder{file, bufio.NewWriter(file)}
+    header := &protocol.ReplayHeader{
+        Seed:            proto.Int64(seed),
+        ProtocolVersion: proto.Uint32(ProtocolVersion),
+    }
+    if err = r.write(header); err != nil {
+        file.Close()
+        return nil, err
+    }
+    log.Println("Recording client input to", filename)
+    return r, nil
+}
+
+func (r *recorder) record(tick uint64, client uint32, msg *protocol.Message) {
+    entry := &protocol.ReplayEntry{
+        Tick:    proto.Uint64(tick),
+        Client:  proto.Uint32(client),
+        Message: msg,
+    }
+    if err := r.write(entry); err != nil {
+        log.Println("Recording failed:", err)
+    }
+}
+
+func (r *recorder) write(pb interface{}) os.Error {
+    bs, err := proto.Marshal(pb)
+    if err != nil {
+        return err
+    }
+    if bs, err = prependByteLength(bs, replayFraming); err != nil {
+        return err
+    }
+    return writeAll(r.w, bs)
+}
+
+func (r *recorder) flush() {
+    if err := r.w.Flush(); err != nil {
+        log.Println("Recording failed:", err)
+    }
+}
+
+func (r *recorder) close() {
+    r.flush()
+    r.file.Close()
+}
+
+// A recorded session. Clients are fed their recorded input through in memory
+// transports, one tick ahead of when it was handed over, so that it is all
+// there when the comm service hands it over again.
+type Replay struct {
+    // Seed the recorded session ran with
+    Seed int64
+    // Entries by tick, in recorded order
+    entries map[uint64][]*protocol.ReplayEntry
+    // Last tick with entries
+    last uint64
+    // Transports and framing of replayed clients, by client number
+    conns   map[uint32]*replayConn
+    framing map[uint32]*framing
+    // Set once Game has been told that the replay is over
+    done bool
+}
+
+// Reads a replay file.
+func LoadReplay(filename string) (*Replay, os.Error) {
+    file, err := os.Open(filename, os.O_RDONLY, 0)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    r := bufio.NewReader(file)
+
+    header := new(protocol.ReplayHeader)
+    if err = readRecord(r, header); err != nil {
+        return nil, err
+    }
+    if v := *header.ProtocolVersion; v > ProtocolVersion {
+        return nil, os.NewError("Replay is from a newer protocol version")
+    }
+    replay := &Replay{*header.Seed, make(map[uint64][]*protocol.ReplayEntry),
+        0, make(map[uint32]*replayConn), make(map[uint32]*framing), false}
+    for {
+        entry := new(protocol.ReplayEntry)
+        if err = readRecord(r, entry); err == os.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        tick := *entry.Tick
+        replay.entries[tick] = append(replay.entries[tick], entry)
+        if tick > replay.last {
+            replay.last = tick
+        }
+    }
+    return replay, nil
+}
+
+func readRecord(r io.Reader, pb interface{}) os.Error {
+    length, err := readLength(r, replayFraming)
+    if err != nil {
+        return err
+    }
+    bs := make([]byte, length)
+    if _, err = io.ReadFull(r, bs); err != nil {
+        return err
+    }
+    return proto.Unmarshal(bs, pb)
+}
+
+// Feeds everything recorded for tick to the replayed clients. New clients are
+// connected right away, so they are waiting to be started at the tick.
+func (r *Replay) prepare(cs *CommService, tick uint64) {
+    if r.done {
+        return
+    }
+    for _, entry := range r.entries[tick] {
+        id, msg := *entry.Client, entry.Message
+        f := r.framing[id]
+        if *msg.Type == protocol.Message_Type(protocol.Message_CONNECT) {
+            conn := newReplayConn(id, cs.input)
+            r.conns[id] = conn
+            nf, err := negotiateFraming(msg.Connect)
+            if err != nil { // The client is refused by connect as well
+                nf = fixedFraming
+            }
+            r.framing[id] = nf
+            f = fixedFraming
+            go connect(cs.svc, cs.input, conn)
+        }
+        conn, ok := r.conns[id]
+        if !ok {
+            log.Println("Replay has input for unknown client", id)
+            continue
+        }
+        bs, err := frameMessage(msg, f)
+        if err != nil {
+            log.Println("Replay has bad input for client", id, err)
+            continue
+        }
+        conn.feed <- bs
+    }
+    if tick > r.last {
+        log.Println("Replay finished")
+        r.done = true
+        util.SendAsync(cs.svc.Game, MsgQuit{})
+    }
+}
+
+// Whether every client recorded at tick has connected and sent all its input
+// for the tick. If a client that should be there never will be, e.g. because
+// its login failed, ready is false and missing is its number.
+func (r *Replay) ready(clients []*client, tick uint64) (ready bool, missing uint32) {
+    present := make(map[uint32]*client, len(clients))
+    for _, cl := range clients {
+        present[cl.id] = cl
+    }
+    input := make(map[uint32]int)
+    ready = true
+    for _, entry := range r.entries[tick] {
+        id := *entry.Client
+        switch *entry.Message.Type {
+        case protocol.Message_Type(protocol.Message_CONNECT),
+            protocol.Message_Type(protocol.Message_LOGIN):
+            // Handshake, the client has to be there
+            if present[id] == nil {
+                if r.gone(id) {
+                    return false, id
+                }
+                ready = false
+            }
+        default:
+            input[id]++
+        }
+    }
+    for id, n := range input {
+        if cl := present[id]; cl == nil {
+            if r.gone(id) {
+                return false, id
+            }
+            ready = false
+        } else if len(cl.pending) < n {
+            ready = false
+        }
+    }
+    return ready, 0
+}
+
+// Whether the transport of a replayed client has been closed
+func (r *Replay) gone(id uint32) bool {
+    conn, ok := r.conns[id]
+    if !ok {
+        return true // Never connected
+    }
+    select {
+    case <-conn.closed:
+        return true
+    default:
+    }
+    return false
+}
+
+// Gives up on the replay and tells Game to quit.
+func (r *Replay) abort(cs *CommService, reason string) {
+    log.Println("Replay stopped:", reason)
+    r.done = true
+    util.SendAsync(cs.svc.Game, MsgQuit{})
+}
+
+// Returns the number of a replayed client, zero for any other client.
+func replayId(cl *client) uint32 {
+    if conn, ok := cl.conn.(*replayConn); ok {
+        return conn.id
+    }
+    return 0
+}
+
+func wrapConnect(connect *protocol.Connect) *protocol.Message {
+    return &protocol.Message{
+        Connect: connect,
+        Type:    protocol.NewMessage_Type(protocol.Message_CONNECT),
+    }
+}
+
+// Wraps a copy of login without the authtoken, passwords are not recorded.
+func wrapLogin(login *protocol.Login) *protocol.Message {
+    return &protocol.Message{
+        Login: &protocol.Login{Name: login.Name, Permissions: login.Permissions},
+        Type:  protocol.NewMessage_Type(protocol.Message_LOGIN),
+    }
+}
+
+// Sent to the comm service when a replayed client's transport is closed, so
+// that it stops waiting for the client if it was.
+type replayClosedMsg struct {
+    id uint32
+}
+
+// Transport of a replayed client. Reads return what was fed to it, writes are
+// discarded.
+type replayConn struct {
+    id     uint32
+    feed   chan Msg // Framed messages to read, never blocks
+    in     chan Msg
+    buf    []byte
+    closed chan bool
+    once   sync.Once
+    notify chan Msg // Comm service input, told when closed
+}
+
+func newReplayConn(id uint32, notify chan Msg) *replayConn {
+    in := make(chan Msg)
+    return &replayConn{id, util.MsgBuffer(in), in, nil, make(chan bool),
+        sync.Once{}, notify}
+}
+
+func (rc *replayConn) Read(p []byte) (int, os.Error) {
+    for len(rc.buf) == 0 {
+        select {
+        case bs := <-rc.in:
+            rc.buf = bs.([]byte)
+        case <-rc.closed:
+            return 0, os.EOF
+        }
+    }
+    n := copy(p, rc.buf)
+    rc.buf = rc.buf[n:]
+    return n, nil
+}
+
+func (rc *replayConn) Write(p []byte) (int, os.Error) { return len(p), nil }
+
+func (rc *replayConn) Close() os.Error {
+    rc.once.Do(func() {
+        close(rc.closed)
+        util.SendAsync(rc.notify, replayClosedMsg{rc.id})
+    })
+    return nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package comm
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "testing"
+    "time"
+    .   "core"
+    "login"
+    "protocol"
+    "util"
+    "goprotobuf.googlecode.com/hg/proto"
+)
+
+const testReplay = "_test_replay"
+
+// Frames fed before the first read must all come out, in order
+func TestReplayConnFeed(t *testing.T) {
+    conn := newReplayConn(1, make(chan Msg, 1))
+    for i := 0; i < 10; i++ {
+        conn.feed <- []byte{byte(i), byte(i)}
+    }
+    got := make([]byte, 20)
+    read := make(chan os.Error)
+    go func() {
+        _, err := io.ReadFull(conn, got)
+        read <- err
+    }()
+    select {
+    case err := <-read:
+        if err != nil {
+            t.Fatalf("Could not read what was fed: %v", err)
+        }
+    case <-time.After(1e8): // 100 ms
+        t.Fatalf("Fed frames were lost")
+    }
+    for i, b := range got {
+        if b != byte(i/2) {
+            t.Fatalf("Read %v, expected the fed frames in order", got)
+        }
+    }
+    conn.Close()
+}
+
+// Recorded input should load back unchanged and grouped by tick
+func TestRecordAndLoad(t *testing.T) {
+    defer os.Remove(testReplay)
+    r, err := newRecorder(testReplay, 42)
+    if err != nil {
+        t.Fatalf("Could not create recorder: %v", err)
+    }
+    login := makeLogin(testName, testPassword, 0).Login
+    r.record(3, 1, makeConnect(ProtocolVersion, fixedFraming))
+    r.record(3, 1, wrapLogin(login))
+    r.record(5, 1, makeDisconnect(protocol.Disconnect_QUIT, "Bye"))
+    r.close()
+
+    replay, err := LoadReplay(testReplay)
+    if err != nil {
+        t.Fatalf("Could not load replay: %v", err)
+    }
+    if replay.Seed != 42 {
+        t.Errorf("Seed %d, expected 42", replay.Seed)
+    }
+    if replay.last != 5 || len(replay.entries[3]) != 2 ||
+        len(replay.entries[5]) != 1 {
+        t.Fatalf("Entries not grouped by tick: %v", replay.entries)
+    }
+    recorded := replay.entries[3][1].Message.Login
+    if recorded == nil || *recorded.Name != testName {
+        t.Errorf("Login not recorded: %v", replay.entries[3][1].Message)
+    } else if recorded.Authtoken != nil {
+        t.Errorf("Password recorded")
+    }
+    if replay.entries[5][0].Message.Disconnect == nil {
+        t.Errorf("Disconnect not recorded")
+    }
+}
+
+// A replayed session should hand the avatar the same input at the same ticks
+// as the recorded one
+func TestReplay(t *testing.T) {
+    defer os.Remove(testReplay)
+    defer func(f func(ServiceContext, chan *protocol.Message) (chan Msg,
+    UniqueId)) {
+        AvatarFunc = f
+    }(AvatarFunc)
+
+    // Record a session
+    accounts := login.NewAccountStore()
+    accounts.Add(testName, testPassword)
+    ctx := startReplayServices(accounts, false)
+    go util.Drain(ctx.Game)
+    var recorded []string
+    AvatarFunc = logAvatar(&recorded)
+    cs := NewCommService(ctx, ":9191")
+    if err := cs.Record(testReplay); err != nil {
+        t.Fatalf("Could not record: %v", err)
+    }
+    go cs.Run(ctx.Comm)
+    time.Sleep(1e8) // 100 ms, give time to start listening
+
+    runTick(t, ctx, 1)
+    fd, err := net.Dial("tcp", "localhost:9191")
+    if err != nil {
+        t.Fatalf("Could not connect to comm: %v", err)
+    }
+    defer fd.Close()
+    sendMessageOrPanic(fd, makeConnect(ProtocolVersion, fixedFraming), fixedFraming)
+    readMessageOrPanic(fd, fixedFraming)
+    if result := loginClient(t, fd, fixedFraming, testName, testPassword); !*result.Succeeded {
+        t.Fatalf("Login failed!")
+    }
+    time.Sleep(1e7) // 10 ms, give time for the client to be added
+    runTick(t, ctx, 2)
+    sendMessageOrPanic(fd, makeAttack(7), fixedFraming)
+    sendMessageOrPanic(fd, makeAttack(8), fixedFraming)
+    time.Sleep(1e7)
+    runTick(t, ctx, 3)
+    sendMessageOrPanic(fd, makeAttack(9), fixedFraming)
+    time.Sleep(1e7)
+    runTick(t, ctx, 4)
+    sendMessageOrPanic(fd, makeDisconnect(protocol.Disconnect_QUIT, "Bye"), fixedFraming)
+    time.Sleep(1e7)
+    runTick(t, ctx, 5)
+    stopComm(ctx)
+
+    expected := []string{"tick", "ATTACK 7", "ATTACK 8", "tick", "ATTACK 9",
+        "tick"}
+    if fmt.Sprint(recorded) != fmt.Sprint(expected) {
+        t.Fatalf("Recorded session got %v, expected %v", recorded, expected)
+    }
+
+    // And replay it, passwords are not recorded so anyone may log in
+    replay, err := LoadReplay(testReplay)
+    if err != nil {
+        t.Fatalf("Could not load replay: %v", err)
+    }
+    ctx = startReplayServices(login.NewAccountStore(), true)
+    go util.Drain(ctx.Game)
+    ctx.Seed = replay.Seed
+    var replayed []string
+    AvatarFunc = logAvatar(&replayed)
+    cs = NewCommService(ctx, "")
+    cs.Replay(replay)
+    go cs.Run(ctx.Comm)
+    for tick := uint64(1); tick <= 5; tick++ {
+        runTick(t, ctx, tick)
+    }
+    stopComm(ctx)
+
+    if fmt.Sprint(replayed) != fmt.Sprint(recorded) {
+        t.Errorf("Replayed session got %v, expected %v", replayed, recorded)
+    }
+}
+
+// A replay whose client can't log in anymore should give up instead of waiting
+// for it forever
+func TestReplayMissingClient(t *testing.T) {
+    defer os.Remove(testReplay)
+    r, err := newRecorder(testReplay, 42)
+    if err != nil {
+        t.Fatalf("Could not create recorder: %v", err)
+    }
+    r.record(2, 1, makeConnect(ProtocolVersion, fixedFraming))
+    r.record(2, 1, wrapLogin(makeLogin(testName, testPassword, 0).Login))
+    r.record(3, 1, makeAttack(7))
+    r.close()
+    replay, err := LoadReplay(testReplay)
+    if err != nil {
+        t.Fatalf("Could not load replay: %v", err)
+    }
+
+    // Nobody may log in
+    ctx := startReplayServices(login.NewAccountStore(), false)
+    quit := make(chan bool, 1)
+    go func() {
+        for {
+            if _, ok := (<-ctx.Game).(MsgQuit); ok {
+                quit <- true
+            }
+        }
+    }()
+    cs := NewCommService(ctx, "")
+    cs.Replay(replay)
+    go cs.Run(ctx.Comm)
+    runTick(t, ctx, 1)
+    runTick(t, ctx, 2)
+    select {
+    case <-quit:
+    case <-time.After(1e9):
+        t.Fatalf("Game not told to quit")
+    }
+    stopComm(ctx)
+}
+
+// Starts the services a deterministic comm service needs, other than Game.
+func startReplayServices(accounts *login.AccountStore,
+autoRegister bool) ServiceContext {
+    ctx := NewServiceContext()
+    ctx.Deterministic = true
+    go util.Drain(ctx.PubSub)
+    go emptyWorld(ctx)
+    ls := login.NewLoginService(ctx, accounts, 0)
+    ls.AutoRegister = autoRegister
+    go ls.Run(ctx.Login)
+    return ctx
+}
+
+// Masquerades as a world with nothing in it
+func emptyWorld(ctx ServiceContext) {
+    for {
+        switch m := (<-ctx.World).(type) {
+        case MsgEntitiesInRadius:
+            m.Reply <- MsgListEntities{}
+        case MsgVisibleEntities:
+            m.Reply <- MsgListEntities{}
+        }
+    }
+}
+
+// Returns an avatar function whose avatars log the input they get and the
+// ticks they are told about to log
+func logAvatar(log *[]string) func(ServiceContext, chan *protocol.Message) (chan Msg, UniqueId) {
+    return func(svc ServiceContext, input chan *protocol.Message) (chan Msg,
+    UniqueId) {
+        ctrl := make(chan Msg)
+        go func() {
+            for {
+                select {
+                case msg := <-ctrl:
+                    switch m := msg.(type) {
+                    case MsgTick:
+                        *log = append(*log, "tick")
+                        m.Origin <- MsgTick{}
+                    case MsgQuit:
+                        return
+                    }
+                case msg := <-input:
+                    entry := messageTypeName(msg)
+                    if msg.Attack != nil {
+                        entry = fmt.Sprint(entry, " ", *msg.Attack.Target)
+                    }
+                    *log = append(*log, entry)
+                }
+            }
+        }()
+        return ctrl, 1
+    }
+}
+
+func makeAttack(target int32) *protocol.Message {
+    return &protocol.Message{
+        Attack: &protocol.Attack{Target: proto.Int32(target)},
+        Type:   protocol.NewMessage_Type(protocol.Message_ATTACK),
+    }
+}
+
+// Ends a tick like Game does and waits until comm has handled it
+func runTick(t *testing.T, ctx ServiceContext, tick uint64) {
+    reply := make(chan Msg)
+    select {
+    case ctx.Comm <- MsgTick{Origin: reply, Tick: tick}:
+    case <-time.After(1e9):
+        t.Fatalf("Comm not taking tick %d", tick)
+    }
+    select {
+    case <-reply:
+    case <-time.After(1e9):
+        t.Fatalf("Tick %d not handed over", tick)
+    }
+}
+
+func stopComm(ctx ServiceContext) {
+    reply := make(chan Msg)
+    ctx.Comm <- MsgQuit{reply}
+    <-reply
+}
@@ -0,0 +1,52 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package comm
+
+// Game code declares here what it wants clients to know about. Anything not
+// declared stays on the server. Declarations should all be made before the
+// comm service is started, they are not safe to change while it runs.
+
+import (
+    .   "core"
+)
+
+// Decides which clients receive a replicated state
+type Visibility int
+
+const (
+    Everyone  Visibility = iota // Every client that can see the entity
+    OwnerOnly                   // Only the client controlling the entity
+)
+
+var (
+    // Entity types that are never sent to clients
+    blacklist = make(map[EntityId]bool)
+    // States that are sent to clients and to whom
+    whitelist = make(map[StateId]Visibility)
+)
+
+// Keeps all entities of the given type from being sent to clients.
+func BlacklistEntity(id EntityId) {
+    blacklist[id] = true
+}
+
+// Marks a state as replicated to the clients allowed by vis.
+func ReplicateState(id StateId, vis Visibility) {
+    whitelist[id] = vis
+}
+
+// Checks to see if this entity is blacklisted
+// Returns true if blacklisted, false otherwise
+func checkBlacklist(id EntityId) bool {
+    return blacklist[id]
+}
+
+// Checks to see if this state is whitelisted for a client. owner is true if
+// the client controls the entity holding the state.
+// Returns true if whitelisted, false otherwise
+func checkWhiteList(id StateId, owner bool) bool {
+    vis, ok := whitelist[id]
+    return ok && (vis == Everyone || owner)
+}
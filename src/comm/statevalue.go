@@ -5,6 +5,7 @@
 package comm
 
 import (
+    "os"
     "reflect"
     .   "core"
     "protocol"
@@ -12,26 +13,23 @@ import (
 )
 
 // Creates the right type of StateValue message for an arbitrary State type.
-func packState(state State) (msg *protocol.StateValue) {
+// Fails if the state holds a type that has no StateValue form.
+func packState(state State) (*protocol.StateValue, os.Error) {
     val := reflect.NewValue(state)
     state_v, ok := val.(*reflect.StructValue)
     if !ok {
-        panic("State is non-struct type!")
+        return nil, os.NewError("State is non-struct type " + val.Type().String())
     }
 
     field_num := state_v.NumField()
     if field_num > 1 { // If we have multiple fields, treat as array
-        msg = &protocol.StateValue{}
-        msg.Type = protocol.NewStateValue_Type(protocol.StateValue_ARRAY)
-        msg.ArrayVal = makeStateValueArray(state_v, field_num)
-    } else { // Single field
-        msg = readField(state_v.Field(0))
+        return makeArray(state_v, field_num)
     }
-    return msg
+    return readField(state_v.Field(0)) // Single field
 }
 
 // Reads a single arbitrary type and returns the proper StateValue.
-func readField(val reflect.Value) *protocol.StateValue {
+func readField(val reflect.Value) (*protocol.StateValue, os.Error) {
     msg := &protocol.StateValue{}
     switch f := val.(type) {
     case *reflect.BoolValue:
@@ -47,32 +45,46 @@ func readField(val reflect.Value) *protocol.StateValue {
         msg.Type = protocol.NewStateValue_Type(protocol.StateValue_STRING)
         msg.StringVal = proto.String(f.Get())
     case *reflect.SliceValue:
-        msg.Type = protocol.NewStateValue_Type(protocol.StateValue_ARRAY)
-        msg.ArrayVal = makeStateValueArray(f, f.Len())
+        return makeArray(f, f.Len())
     case *reflect.StructValue:
-        msg = readStructField(f)
+        return readStructField(f)
     case *reflect.PtrValue:
+        if f.IsNil() {
+            return nil, os.NewError("State value is a nil " + val.Type().String())
+        }
         return readField(reflect.Indirect(f)) // Dereference and recurse
     default:
-        panic("State value not supported: " + val.Type().String())
+        return nil, os.NewError("State value not supported: " +
+            val.Type().String())
     }
-    return msg
+    return msg, nil
 }
 
-// Reads a field that is not a builtin type, but a user created struct. These
-// types have specific message types so the receiving end can identify them.
-func readStructField(val *reflect.StructValue) *protocol.StateValue {
-    t := val.Type()
-    switch t.Name() {
-    case "V3": // Vector type:
+// Reads a field that is not a builtin type, but a user created struct. Types
+// with specific message types are sent as those so the receiving end can
+// identify them, other structs as an array of their fields.
+func readStructField(val *reflect.StructValue) (*protocol.StateValue, os.Error) {
+    if val.Type().Name() == "V3" { // Vector type
         return makeVector3(val)
     }
-    panic("Struct value not supported: " + t.String())
-    return nil // Will never get here
+    return makeArray(val, val.NumField())
+}
+
+// Makes an array StateValue from the fields of a struct or the elements of a
+// slice.
+func makeArray(value reflect.Value, num int) (*protocol.StateValue, os.Error) {
+    array, err := makeStateValueArray(value, num)
+    if err != nil {
+        return nil, err
+    }
+    msg := &protocol.StateValue{}
+    msg.Type = protocol.NewStateValue_Type(protocol.StateValue_ARRAY)
+    msg.ArrayVal = array
+    return msg, nil
 }
 
 // Creates a slice of StateValues based on multiple arbitrary types.
-func makeStateValueArray(value reflect.Value, num int) []*protocol.StateValue {
+func makeStateValueArray(value reflect.Value, num int) ([]*protocol.StateValue, os.Error) {
     msg_array := make([]*protocol.StateValue, 0, num)
 
     // One of these will be valid, the other will not
@@ -88,22 +100,155 @@ func makeStateValueArray(value reflect.Value, num int) []*protocol.StateValue {
         } else {
             val = slice_v.Elem(i)
         }
-        msg_array = append(msg_array, readField(val))
+        sv, err := readField(val)
+        if err != nil {
+            return nil, err
+        }
+        msg_array = append(msg_array, sv)
     }
-    return msg_array
+    return msg_array, nil
 }
 
-// Makes a Vector3 StateValue. Panics if the StructValue fields do not match the vector.
-func makeVector3(v *reflect.StructValue) *protocol.StateValue {
-    // If we panic here, struct layout was not as expected
-    x := v.FieldByName("X").(*reflect.FloatValue).Get()
-    y := v.FieldByName("Y").(*reflect.FloatValue).Get()
-    z := v.FieldByName("Z").(*reflect.FloatValue).Get()
+// Makes a Vector3 StateValue. Fails if the StructValue fields do not match
+// the vector.
+func makeVector3(v *reflect.StructValue) (*protocol.StateValue, os.Error) {
+    x, okx := v.FieldByName("X").(*reflect.FloatValue)
+    y, oky := v.FieldByName("Y").(*reflect.FloatValue)
+    z, okz := v.FieldByName("Z").(*reflect.FloatValue)
+    if !okx || !oky || !okz {
+        return nil, os.NewError("Not a vector: " + v.Type().String())
+    }
+    vx, vy, vz := x.Get(), y.Get(), z.Get()
 
-    vector3 := &protocol.Vector3{&x, &y, &z, nil}
+    vector3 := &protocol.Vector3{&vx, &vy, &vz, nil}
     sv := &protocol.StateValue{
         Type:       protocol.NewStateValue_Type(protocol.StateValue_VECTOR3),
         Vector3Val: vector3,
     }
-    return sv
+    return sv, nil
+}
+
+// Creates the State registered under id from a StateValue made by packState.
+func unpackState(id StateId, sv *protocol.StateValue) (State, os.Error) {
+    t, ok := StateType(id)
+    if !ok {
+        _, err := NewState(id) // Reports the unknown id
+        return nil, err
+    }
+    state_v, ok := reflect.MakeZero(t).(*reflect.StructValue)
+    if !ok {
+        return nil, os.NewError("State is non-struct type " + t.String())
+    }
+
+    var err os.Error
+    field_num := state_v.NumField()
+    if field_num > 1 { // Multiple fields were packed as an array
+        err = writeStateValueArray(state_v, field_num, sv)
+    } else {
+        err = writeField(state_v.Field(0), sv)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return state_v.Interface().(State), nil
+}
+
+// Sets a single arbitrary type from a StateValue. The reverse of readField.
+func writeField(val reflect.Value, sv *protocol.StateValue) os.Error {
+    if sv == nil || sv.Type == nil {
+        return os.NewError("Missing state value for " + val.Type().String())
+    }
+    mismatch := os.NewError("State value does not match " + val.Type().String())
+    switch f := val.(type) {
+    case *reflect.BoolValue:
+        if sv.BoolVal == nil {
+            return mismatch
+        }
+        f.Set(*sv.BoolVal)
+    case *reflect.IntValue:
+        if sv.IntVal == nil {
+            return mismatch
+        }
+        f.Set(int64(*sv.IntVal))
+    case *reflect.FloatValue:
+        if sv.FloatVal == nil {
+            return mismatch
+        }
+        f.Set(float64(*sv.FloatVal))
+    case *reflect.StringValue:
+        if sv.StringVal == nil {
+            return mismatch
+        }
+        f.Set(*sv.StringVal)
+    case *reflect.SliceValue:
+        if *sv.Type != protocol.StateValue_Type(protocol.StateValue_ARRAY) {
+            return mismatch
+        }
+        n := len(sv.ArrayVal)
+        slice := reflect.MakeSlice(f.Type().(*reflect.SliceType), n, n)
+        if err := writeStateValueArray(slice, n, sv); err != nil {
+            return err
+        }
+        f.Set(slice)
+    case *reflect.StructValue:
+        return writeStructField(f, sv)
+    case *reflect.PtrValue:
+        elem := reflect.MakeZero(f.Type().(*reflect.PtrType).Elem())
+        if err := writeField(elem, sv); err != nil {
+            return err
+        }
+        f.PointTo(elem)
+    default:
+        return os.NewError("State value not supported: " + val.Type().String())
+    }
+    return nil
+}
+
+// Sets a user created struct field. The reverse of readStructField.
+func writeStructField(val *reflect.StructValue, sv *protocol.StateValue) os.Error {
+    if val.Type().Name() != "V3" { // Sent as an array of its fields
+        return writeStateValueArray(val, val.NumField(), sv)
+    }
+    x, okx := val.FieldByName("X").(*reflect.FloatValue)
+    y, oky := val.FieldByName("Y").(*reflect.FloatValue)
+    z, okz := val.FieldByName("Z").(*reflect.FloatValue)
+    if !okx || !oky || !okz {
+        return os.NewError("Not a vector: " + val.Type().String())
+    }
+    v := sv.Vector3Val
+    if v == nil || v.X == nil || v.Y == nil || v.Z == nil {
+        return os.NewError("State value is not a vector")
+    }
+    x.Set(*v.X)
+    y.Set(*v.Y)
+    z.Set(*v.Z)
+    return nil
+}
+
+// Sets the fields of a struct or the elements of a slice from an array
+// StateValue. The reverse of makeStateValueArray.
+func writeStateValueArray(value reflect.Value, num int, sv *protocol.StateValue) os.Error {
+    if sv == nil || sv.Type == nil ||
+        *sv.Type != protocol.StateValue_Type(protocol.StateValue_ARRAY) ||
+        len(sv.ArrayVal) != num {
+        return os.NewError("State value does not match " + value.Type().String())
+    }
+
+    // One of these will be valid, the other will not
+    struct_v, ok := value.(*reflect.StructValue)
+    slice_v, ok2 := value.(*reflect.SliceValue)
+    _, _ = ok, ok2 // These can be safely ignored
+
+    for i := 0; i < num; i++ {
+        var val reflect.Value
+        if struct_v != nil {
+            val = struct_v.Field(i)
+        } else {
+            val = slice_v.Elem(i)
+        }
+        if err := writeField(val, sv.ArrayVal[i]); err != nil {
+            return err
+        }
+    }
+    return nil
 }
@@ -45,6 +45,25 @@ type v3FieldState struct {
 func (x v3FieldState) Id() StateId  { return 4 }
 func (x v3FieldState) Name() string { return "v3FieldState" }
 
+type pair struct {
+    Name  string
+    Value float32
+}
+
+type structSliceState struct {
+    Value []pair
+}
+
+func (x structSliceState) Id() StateId  { return 5 }
+func (x structSliceState) Name() string { return "structSliceState" }
+
+type mapFieldState struct {
+    Value map[string]int
+}
+
+func (x mapFieldState) Id() StateId  { return 6 }
+func (x mapFieldState) Name() string { return "mapFieldState" }
+
 func TestSingleFieldState(t *testing.T) {
     // testState is made available by observer_test.go
     state := testState{9}
@@ -52,7 +71,7 @@ func TestSingleFieldState(t *testing.T) {
     sv.Type = protocol.NewStateValue_Type(protocol.StateValue_INT)
     sv.IntVal = proto.Int(state.Value)
 
-    equalOrError(t, sv, packState(state))
+    equalOrError(t, sv, state)
 }
 
 func TestMultipleFieldState(t *testing.T) {
@@ -65,7 +84,7 @@ func TestMultipleFieldState(t *testing.T) {
     inner_v2 := makeIntValMsg(b)
     sv.ArrayVal = append([]*protocol.StateValue{}, inner_v1, inner_v2)
 
-    equalOrError(t, sv, packState(state))
+    equalOrError(t, sv, state)
 }
 
 func TestSliceFieldState(t *testing.T) {
@@ -80,7 +99,7 @@ func TestSliceFieldState(t *testing.T) {
     }
     sv.ArrayVal = msgs
 
-    equalOrError(t, sv, packState(state))
+    equalOrError(t, sv, state)
 }
 
 func TestPtrFieldState(t *testing.T) {
@@ -90,7 +109,7 @@ func TestPtrFieldState(t *testing.T) {
     sv.Type = protocol.NewStateValue_Type(protocol.StateValue_INT)
     sv.IntVal = proto.Int(*state.Value)
 
-    equalOrError(t, sv, packState(state))
+    equalOrError(t, sv, state)
 }
 
 func TestV3FieldState(t *testing.T) {
@@ -100,12 +119,67 @@ func TestV3FieldState(t *testing.T) {
     sv.Type = protocol.NewStateValue_Type(protocol.StateValue_VECTOR3)
     sv.Vector3Val = &protocol.Vector3{&vec.X, &vec.Y, &vec.Z, nil}
 
-    equalOrError(t, sv, packState(state))
+    equalOrError(t, sv, state)
+}
+
+// Unpacking a packed state should give back the same state
+func TestUnpackState(t *testing.T) {
+    num := 9
+    states := []State{
+        multipleFieldState{1, 2},
+        sliceFieldState{[]int{1, 2, 3}},
+        ptrFieldState{&num},
+        v3FieldState{s3dm.V3{1, 2, 3}},
+        structSliceState{[]pair{pair{"a", 1}, pair{"b", 0.5}}},
+    }
+    for _, state := range states {
+        RegisterState(state)
+        sv, err := packState(state)
+        if err != nil {
+            t.Errorf("Could not pack %s: %v", state.Name(), err)
+            continue
+        }
+        unpacked, err := unpackState(state.Id(), sv)
+        if err != nil {
+            t.Errorf("Could not unpack %s: %v", state.Name(), err)
+        } else if !reflect.DeepEqual(state, unpacked) {
+            t.Errorf("Unpacked %s does not match: %v", state.Name(), unpacked)
+        }
+    }
+}
+
+// Values of the wrong type should be an error, not a panic
+func TestUnpackMismatch(t *testing.T) {
+    RegisterState(multipleFieldState{})
+    if _, err := unpackState(1, makeIntValMsg(1)); err == nil {
+        t.Error("Unpacked an int as an array")
+    }
+    if _, err := unpackState(99, makeIntValMsg(1)); err == nil {
+        t.Error("Unpacked an unregistered state")
+    }
+}
+
+// Unsupported types should be an error, not a panic
+func TestUnsupportedState(t *testing.T) {
+    state := mapFieldState{map[string]int{"a": 1}}
+    if _, err := packState(state); err == nil {
+        t.Error("Packed a map")
+    }
+    RegisterState(state)
+    if _, err := unpackState(state.Id(), makeIntValMsg(1)); err == nil {
+        t.Error("Unpacked a map")
+    }
+    if _, err := packState(ptrFieldState{nil}); err == nil {
+        t.Error("Packed a nil pointer")
+    }
 }
 
-// Returns an error if two StateValues are not equal
-func equalOrError(t *testing.T, sv, pack interface{}) {
-    if !reflect.DeepEqual(sv, pack) {
+// Reports an error if state does not pack to sv
+func equalOrError(t *testing.T, sv *protocol.StateValue, state State) {
+    pack, err := packState(state)
+    if err != nil {
+        t.Errorf("Could not pack %s: %v", state.Name(), err)
+    } else if !reflect.DeepEqual(sv, pack) {
         t.Error("Test state and packed state value messages do not match!")
     }
 }
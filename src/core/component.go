@@ -7,7 +7,10 @@
 package core
 
 import (
+    "fmt"
+    "rand"
     "runtime"
+    "sort"
     "core/cmpId"
 )
 
@@ -55,10 +58,17 @@ type Entity interface {
     // Sets the value of the passed State within the Entity. Overwrites any
     // previous state with the same ID.
     SetState(state State)
+    // Removes the State with the passed ID from the Entity, if it has one.
+    RemoveState(id StateId)
     // Adds the Action to the Entity.
     AddAction(action Action)
     // Removes the Action from the Entity.
     RemoveAction(action Action)
+    // Returns the last tick the Entity received from Game.
+    LastTick() MsgTick
+    // Returns the Entity's own random number generator. Actions should use
+    // it instead of the global one to keep deterministic mode deterministic.
+    Rand() *rand.Rand
     // Runs the Entity's main loop.
     Run(svc ServiceContext)
     // Returns the Entity's communication channel. Returns nil if Run() has not
@@ -84,7 +94,20 @@ type CmpData struct {
     // Use maps for easy/add remove for now
     states  StateList
     actions ActionList
-    input   chan Msg
+    // Incremented by every state change
+    version uint64
+    // Value of version when each state was last changed. Any state changed
+    // after a given version is dirty relative to it.
+    changed map[StateId]uint64
+    // Value of version when each state was removed
+    removed map[StateId]uint64
+    // Last tick received from Game
+    tick MsgTick
+    // Actions to run at the start of the next tick
+    deferred []MsgRunAction
+    // Created on first use, see Rand
+    rand  *rand.Rand
+    input chan Msg
 }
 
 // Creates a CmpData and initializes its containers. The passed values are data
@@ -93,8 +116,11 @@ func NewCmpData(uid UniqueId, id EntityId, name string) *CmpData {
     hq := NewHandlerQueue()
     states := make(StateList)
     actions := make(ActionList)
+    changed := make(map[StateId]uint64)
+    removed := make(map[StateId]uint64)
     ch := make(chan Msg)
-    return &CmpData{hq, ServiceContext{}, uid, id, name, states, actions, ch}
+    return &CmpData{hq, ServiceContext{}, uid, id, name, states, actions, 0,
+        changed, removed, MsgTick{}, nil, nil, ch}
 }
 
 // The next functions form the core functionality of a component.
@@ -103,6 +129,18 @@ func (cd *CmpData) Uid() UniqueId { return cd.uid }
 func (cd *CmpData) Id() EntityId  { return cd.id }
 func (cd *CmpData) Name() string  { return cd.name }
 
+// Returns the last tick received, the zero MsgTick before the first one.
+func (cd *CmpData) LastTick() MsgTick { return cd.tick }
+
+// Returns the random number generator of this entity. It is seeded from the
+// ServiceContext and uid, so it must not be used before Run.
+func (cd *CmpData) Rand() *rand.Rand {
+    if cd.rand == nil {
+        cd.rand = cd.svc.NewRand(fmt.Sprint("entity ", cd.uid))
+    }
+    return cd.rand
+}
+
 // Returns the requested State. It is up to the caller to verify that the wanted
 // state was actually returned.
 func (cd *CmpData) GetState(id StateId) State {
@@ -110,8 +148,24 @@ func (cd *CmpData) GetState(id StateId) State {
 }
 
 // Set the value of the passed State. Replaces any existing State that is the same.
+// The state is marked as changed.
 func (cd *CmpData) SetState(state State) {
+    cd.version++
     cd.states[state.Id()] = state
+    cd.changed[state.Id()] = cd.version
+    cd.removed[state.Id()] = 0, false
+}
+
+// Removes the State with the passed ID. The removal is recorded like a change
+// so that it can be passed on.
+func (cd *CmpData) RemoveState(id StateId) {
+    if _, ok := cd.states[id]; !ok {
+        return
+    }
+    cd.version++
+    cd.states[id] = nil, false
+    cd.changed[id] = 0, false
+    cd.removed[id] = cd.version
 }
 
 // Adds to an Entity's actions, causing the Action to be executed on the next tick.
@@ -142,31 +196,62 @@ func (cd *CmpData) handle(msg Msg) {
         // Check at the start of the tick because Game actually removes at
         // the end of the previous tick
         if _, ok := cd.states[cmpId.Remove]; ok {
-            Send(cd, m.Origin, MsgTick{cd.input})
+            Send(cd, m.Origin, MsgTick{Origin: cd.input})
             runtime.Goexit() // Entity was removed, bail
         }
+        cd.tick = m
+        cd.runDeferred()
         cd.update(cd.svc)
-        Send(cd, m.Origin, MsgTick{cd.input}) // Reply that we are updated
+        Send(cd, m.Origin, MsgTick{Origin: cd.input}) // Reply that we are updated
+    case MsgQuit:
+        AckQuit(cd, m)
+        runtime.Goexit() // Server is shutting down
     case MsgGetState:
         cd.sendState(m)
     case MsgGetAllStates:
         cd.sendAllStates(m)
+    case MsgGetChangedStates:
+        cd.sendChangedStates(m)
     case MsgSetState:
         cd.SetState(m.State)
+    case MsgRemoveState:
+        cd.RemoveState(m.Id)
     case MsgAddAction:
         cd.AddAction(m.Action)
     case MsgRunAction:
-        m.Action.Act(cd, cd.svc)
-        if m.Add {
-            cd.AddAction(m.Action)
-        }
+        // Whenever it arrives, it takes effect with the next tick, so that
+        // pausing and the time scale apply to it like to everything else
+        cd.deferred = append(cd.deferred, m)
+    }
+}
+
+func (cd *CmpData) runAction(msg MsgRunAction) {
+    msg.Action.Act(cd, cd.svc)
+    if msg.Add {
+        cd.AddAction(msg.Action)
     }
 }
 
-// Loop through each Action and let it run
+// Runs the actions deferred since the last tick in the order they arrived
+func (cd *CmpData) runDeferred() {
+    for _, m := range cd.deferred {
+        cd.runAction(m)
+    }
+    cd.deferred = cd.deferred[:0]
+}
+
+// Loop through each Action and let it run, ordered by id so that every run
+// does the same
 func (cd *CmpData) update(svc ServiceContext) {
-    for _, v := range cd.actions {
-        v.Act(cd, svc)
+    ids := make([]int, 0, len(cd.actions))
+    for id := range cd.actions {
+        ids = append(ids, int(id))
+    }
+    sort.SortInts(ids)
+    for _, id := range ids {
+        if a, ok := cd.actions[ActionId(id)]; ok { // May have been removed
+            a.Act(cd, svc)
+        }
     }
 }
 
@@ -184,6 +269,22 @@ func (cd *CmpData) sendAllStates(msg MsgGetAllStates) {
     close(msg.Reply)
 }
 
+// Send back the states changed and removed since the requested version
+func (cd *CmpData) sendChangedStates(msg MsgGetChangedStates) {
+    changes := MsgStateChanges{cd.version, make([]State, 0, 4), nil}
+    for id, version := range cd.changed {
+        if version > msg.Since {
+            changes.States = append(changes.States, cd.states[id])
+        }
+    }
+    for id, version := range cd.removed {
+        if version > msg.Since {
+            changes.Removed = append(changes.Removed, id)
+        }
+    }
+    Send(cd, msg.Reply, changes)
+}
+
 // Entity descriptor, contains all the relevant information for a given entity
 // in one neat little package.
 type EntityDesc struct {
@@ -70,3 +70,17 @@ func (hq *HandlerQueue) GetMsg(ch chan Msg) Msg {
     }
     return <-ch
 }
+
+// GetMsgOrTimeout is like GetMsg, but gives up and returns false once timeout
+// fires. A nil timeout never fires.
+func (hq *HandlerQueue) GetMsgOrTimeout(ch chan Msg, timeout <-chan int64) (Msg, bool) {
+    if len(hq.msgs) > 0 {
+        return hq.GetMsg(ch), true
+    }
+    select {
+    case msg := <-ch:
+        return msg, true
+    case <-timeout:
+    }
+    return nil, false
+}
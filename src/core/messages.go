@@ -11,14 +11,22 @@ package core
 type Msg interface{}
 
 // Message to signal an update and/or updated status.
-// A completion of update reply should be sent to the Origin channel.
+// A completion of update reply should be sent to the Origin channel. Ticks sent
+// by Game also say which tick it is and how much time it covers, replies and
+// service ready messages only need Origin.
 type MsgTick struct {
     Origin chan Msg // Identifies the sources of the tick
+    Tick   uint64   // Number of the tick, starting at 1
+    Dt     float64  // Simulated seconds covered by this tick
+    Wall   int64    // Wall clock time the tick started, in nanoseconds
 }
 
 // Tells the receiver to quit, shutdown, stop, halt, cease operations, close for
-// business, etc..
-type MsgQuit struct{}
+// business, etc.. If Reply is not nil, the receiver sends MsgQuit{} on it once
+// it has stopped.
+type MsgQuit struct {
+    Reply chan Msg
+}
 
 // Message requesting a certain state to be returned
 // Contains a channel where the reply should be sent
@@ -32,6 +40,11 @@ type MsgSetState struct {
     State State
 }
 
+// Message requesting that a certain state should be removed
+type MsgRemoveState struct {
+    Id StateId
+}
+
 // Message requesting all states that an entity has. Reply will be ranged over
 // by the originator of request and should be closed  once all states have been
 // sent.
@@ -39,13 +52,28 @@ type MsgGetAllStates struct {
     Reply chan Msg // Reply type is State
 }
 
+// Message requesting the states that changed after the version Since. Versions
+// start at zero, so asking for changes since zero returns every state.
+type MsgGetChangedStates struct {
+    Since uint64
+    Reply chan Msg // Reply type is MsgStateChanges
+}
+
+// Reply to MsgGetChangedStates. Version is the entity's current version, which
+// should be passed as Since in the next request.
+type MsgStateChanges struct {
+    Version uint64
+    States  []State   // States set since the requested version
+    Removed []StateId // States removed since the requested version
+}
+
 // Message to add an action that contains the action to be added
 type MsgAddAction struct {
     Action Action
 }
 
-// Requests that the action be run immediately. Will be optionally added for
-// re-use depending on the Add variable.
+// Requests that the action be run at the start of the entity's next tick. Will
+// be optionally added for re-use depending on the Add variable.
 type MsgRunAction struct {
     Action Action
     Add    bool
@@ -60,6 +88,71 @@ type MsgListEntities struct {
     Entities []*EntityDesc
 }
 
+// Requests the entities within Radius of the entity identified by Uid, the
+// entity itself included. Answered by the World service with a
+// MsgListEntities, whose list is empty if the entity has no known position.
+type MsgEntitiesInRadius struct {
+    Uid    UniqueId
+    Radius float64
+    Reply  chan Msg // Reply type is MsgListEntities
+}
+
+// Requests the entities whose position is within the rectangle from (MinX, MinY)
+// to (MaxX, MaxY) in the XY plane, edges included. Answered by the World
+// service with a MsgListEntities.
+type MsgEntitiesInRect struct {
+    MinX, MinY float64
+    MaxX, MaxY float64
+    Reply      chan Msg // Reply type is MsgListEntities
+}
+
+// Requests the entity of type Id closest to the entity identified by Uid, the
+// entity itself excluded, measured in the XY plane. Only entities within
+// MaxDist are considered, any distance if MaxDist <= 0. Answered by the World
+// service.
+type MsgNearestEntity struct {
+    Uid     UniqueId
+    Id      EntityId
+    MaxDist float64
+    Reply   chan Msg // Reply type is *EntityDesc, nil if there is none
+}
+
+// Requests whether the cell of (ToX, ToY) can be seen from the cell of
+// (FromX, FromY), which is the case unless a cell in between blocks sight.
+// Answered by the World service.
+type MsgLineOfSight struct {
+    FromX, FromY float64
+    ToX, ToY     float64
+    Reply        chan Msg // Reply type is bool
+}
+
+// A cell of the world, given by its integer coordinates
+type Cell struct {
+    X, Y int
+}
+
+// Requests the cells within Radius of the cell of (X, Y) that can be seen from
+// it, that cell included. Answered by the World service with a MsgVisibleCells.
+type MsgFieldOfView struct {
+    X, Y   float64
+    Radius float64
+    Reply  chan Msg // Reply type is MsgVisibleCells
+}
+
+// Answer to MsgFieldOfView, cells are sorted by Y and then by X
+type MsgVisibleCells struct {
+    Cells []Cell
+}
+
+// Requests the entities within Radius of the entity identified by Uid that it
+// can see, the entity itself included. Answered by the World service like
+// MsgEntitiesInRadius.
+type MsgVisibleEntities struct {
+    Uid    UniqueId
+    Radius float64
+    Reply  chan Msg // Reply type is MsgListEntities
+}
+
 // Signals that a specific entity has been added to the game
 type MsgEntityAdded struct {
     Entity *EntityDesc
@@ -70,6 +163,12 @@ type MsgEntityRemoved struct {
     Entity *EntityDesc
 }
 
+// Signals that an entity has crashed and should be removed from the game. The
+// entity still answers messages until it is sent MsgQuit.
+type MsgEntityCrashed struct {
+    Entity *EntityDesc
+}
+
 // Assigns control of this entity to a client
 type MsgAssignControl struct {
     Uid     UniqueId // Entity to be given to a client
@@ -82,9 +181,29 @@ type MsgEntityDeath struct {
     Killer *EntityDesc
 }
 
+// The static terrain of a rectangular area of the world. Cells outside of it
+// are open ground.
+type MsgTerrain struct {
+    X, Y          int      // Position of the first cell
+    Width, Height int      // Size of the area in cells
+    Cells         []byte   // Terrain type of each cell, row by row
+    Types         []string // Names of the terrain types by value
+}
+
+// How an attack went
+type HitOutcome int
+
+// Values match the protocol's CombatHit.Outcome
+const (
+    HitNormal   HitOutcome = iota // Normal damage
+    HitMissed                     // No damage
+    HitCritical                   // Extra damage
+)
+
 // Represents damage dealt in combat
 type MsgCombatHit struct {
     Attacker *EntityDesc
     Victim   *EntityDesc
-    Damage   float32
+    Damage   float32 // After resistances, 0 for a miss
+    Outcome  HitOutcome
 }
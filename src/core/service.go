@@ -4,14 +4,52 @@
 
 package core
 
+import (
+    "rand"
+    "time"
+)
+
 type Service interface {
     Run(input chan Msg)
 }
 
 type ServiceContext struct {
-    Game, Comm, PubSub, World chan Msg
+    Game, Comm, PubSub, World, Login chan Msg
+    // Seed for all random number generators, see NewRand
+    Seed int64
+    // If true, the simulation only depends on Seed and client input. Entities
+    // are updated one at a time in a fixed order and input is only applied at
+    // tick boundaries.
+    Deterministic bool
 }
 
 func NewServiceContext() ServiceContext {
-    return ServiceContext{make(chan Msg), make(chan Msg), make(chan Msg), make(chan Msg)}
+    return ServiceContext{make(chan Msg), make(chan Msg), make(chan Msg),
+        make(chan Msg), make(chan Msg), time.Nanoseconds(), false}
+}
+
+// Returns a random number generator for the named user, e.g. a service. Its
+// seed depends only on Seed and name, so with the same Seed every user gets
+// the same numbers on every run, whatever the others do.
+func (svc ServiceContext) NewRand(name string) *rand.Rand {
+    seed := svc.Seed
+    for _, c := range name {
+        seed = seed*31 + int64(c)
+    }
+    return rand.New(rand.NewSource(seed))
+}
+
+// Stops a service or entity by sending it MsgQuit and waits until it has
+// acknowledged quitting.
+func Stop(hnd MsgHandler, ch chan Msg) {
+    reply := make(chan Msg)
+    Send(hnd, ch, MsgQuit{reply})
+    Recv(hnd, reply)
+}
+
+// Acknowledges a MsgQuit, if its sender asked for it.
+func AckQuit(hnd MsgHandler, msg MsgQuit) {
+    if msg.Reply != nil {
+        Send(hnd, msg.Reply, MsgQuit{})
+    }
 }
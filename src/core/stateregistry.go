@@ -0,0 +1,61 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package core
+
+import (
+    "fmt"
+    "gob"
+    "os"
+    "reflect"
+)
+
+// Concrete State types by StateId, so that states can be rebuilt from their id
+// and some encoded form.
+var stateTypes = make(map[StateId]reflect.Type)
+
+// Ids of the registered states by name
+var stateNames = make(map[string]StateId)
+
+func init() {
+    RegisterState(Remove{})
+}
+
+// Registers the concrete type of state under state.Id(), e.g.
+// RegisterState(Position{}). The type is registered with gob as well, so it can
+// be stored in interface values. Registering a different type under an id that
+// is already taken panics. Must be called before any state of the type is
+// encoded or decoded.
+func RegisterState(state State) {
+    t := reflect.Typeof(state)
+    if old, ok := stateTypes[state.Id()]; ok {
+        if old != t {
+            panic(fmt.Sprintf("State id %d registered for both %s and %s",
+                state.Id(), old, t))
+        }
+        return
+    }
+    stateTypes[state.Id()] = t
+    stateNames[state.Name()] = state.Id()
+    gob.Register(state)
+}
+
+// Returns the reflection type of the state registered under id.
+func StateType(id StateId) (t reflect.Type, ok bool) {
+    t, ok = stateTypes[id]
+    return
+}
+
+// Returns the zero value of the state registered under id.
+func NewState(id StateId) (State, os.Error) {
+    t, ok := stateTypes[id]
+    if !ok {
+        return nil, unknownState(id)
+    }
+    return reflect.MakeZero(t).Interface().(State), nil
+}
+
+func unknownState(id StateId) os.Error {
+    return os.NewError(fmt.Sprintf("No state registered with id %d", id))
+}
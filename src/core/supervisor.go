@@ -0,0 +1,108 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+// Supervision of entity and service goroutines. A panic in one of them is
+// recovered and logged instead of taking down the whole server.
+
+package core
+
+import (
+    "fmt"
+    "log"
+    "runtime/debug"
+    "time"
+)
+
+// Decides whether and how often a crashed service is restarted.
+type RestartPolicy struct {
+    // Number of restarts before giving up, unlimited if < 0
+    MaxRestarts int
+    // Nanoseconds to wait before each restart
+    Delay int64
+}
+
+var DefaultRestartPolicy = RestartPolicy{5, 1e8} // 100ms
+
+// Runs ent, recovering from any panic inside it. A crashed entity reports
+// itself to Game with MsgEntityCrashed and then keeps answering requests until
+// it is told to quit, so nothing that was waiting on it blocks forever.
+func SuperviseEntity(ent Entity, svc ServiceContext) {
+    defer func() {
+        if e := recover(); e != nil {
+            logCrash(fmt.Sprintf("entity %d (%s)", ent.Uid(), ent.Name()), e)
+            z := &zombie{NewHandlerQueue(), ent}
+            z.run(svc)
+        }
+    }()
+    ent.Run(svc)
+}
+
+// Runs the service s, restarting it with the same instance and input
+// according to policy whenever it crashes. Returns once the service quits
+// normally or policy gives up on it.
+func SuperviseService(name string, s Service, input chan Msg,
+policy RestartPolicy) {
+    for restarts := 0; ; restarts++ {
+        if !runService(name, s, input) {
+            return // Quit normally
+        }
+        if policy.MaxRestarts >= 0 && restarts >= policy.MaxRestarts {
+            log.Printf("%s: crashed %d times, giving up", name, restarts+1)
+            // Still let shutdown go through
+            for {
+                if m, ok := (<-input).(MsgQuit); ok {
+                    if m.Reply != nil {
+                        m.Reply <- MsgQuit{}
+                    }
+                    return
+                }
+            }
+        }
+        log.Printf("%s: restarting", name)
+        time.Sleep(policy.Delay)
+    }
+}
+
+// Runs the service and returns whether it crashed.
+func runService(name string, s Service, input chan Msg) (crashed bool) {
+    defer func() {
+        if e := recover(); e != nil {
+            logCrash(name, e)
+            crashed = true
+        }
+    }()
+    s.Run(input)
+    return false
+}
+
+func logCrash(who string, e interface{}) {
+    log.Printf("%s crashed: %v\n%s", who, e, debug.Stack())
+}
+
+// Stands in for a crashed entity until Game has removed it.
+type zombie struct {
+    *HandlerQueue
+    ent Entity
+}
+
+func (z *zombie) Chan() chan Msg { return z.ent.Chan() }
+
+func (z *zombie) run(svc ServiceContext) {
+    Send(z, svc.Game, MsgEntityCrashed{NewEntityDesc(z.ent)})
+    for {
+        switch m := z.GetMsg(z.Chan()).(type) {
+        case MsgTick:
+            Send(z, m.Origin, MsgTick{Origin: z.Chan()})
+        case MsgGetState:
+            Send(z, m.Reply, nil)
+        case MsgGetAllStates:
+            close(m.Reply)
+        case MsgGetChangedStates:
+            Send(z, m.Reply, MsgStateChanges{Version: m.Since})
+        case MsgQuit:
+            AckQuit(z, m)
+            return
+        }
+    }
+}
@@ -0,0 +1,257 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package core
+
+import (
+    "fmt"
+    "io/ioutil"
+    "json"
+    "os"
+    "reflect"
+)
+
+// Concrete Action types by name, so that templates can attach them
+var actionTypes = make(map[string]reflect.Type)
+
+// Entity type ids by name, so that templates can refer to them
+var entityTypes = make(map[string]EntityId)
+
+// Registers the concrete type of action under action.Name(), e.g.
+// RegisterAction(Move{}), so that templates can attach it to entities.
+func RegisterAction(action Action) {
+    actionTypes[action.Name()] = reflect.Typeof(action)
+}
+
+// Registers the entity type id under name, so that templates can give their
+// Type by name instead of by number.
+func RegisterEntity(name string, id EntityId) {
+    entityTypes[name] = id
+}
+
+// A prototype of an entity, loaded from a data file by LoadTemplates.
+//
+// States and actions are given by name. A state or action with a single field
+// is given as the value of that field, one with several fields as an object
+// of field values by field name, just like packState does for clients. For
+// example:
+//
+//     {
+//         "Name": "Spider",
+//         "Type": "Spider",
+//         "States": {
+//             "Position": {"X": 1, "Y": 1, "Z": 0},
+//             "Asset": "s",
+//             "Health": 4
+//         },
+//         "Actions": {}
+//     }
+type Template struct {
+    // Name of the template and of the entities spawned from it
+    Name string
+    // Name of the entity type, as registered with RegisterEntity
+    Type string
+    // Entity type id (defined in cmpId package), looked up from Type
+    Id EntityId
+    // Entities that are not saved in snapshots, like players, which are
+    // spawned again when their clients log in
+    Transient bool
+    // Initial states and attached actions by name, as decoded from JSON. They
+    // are built anew for every entity, so entities never share values.
+    States  map[string]interface{}
+    Actions map[string]interface{}
+}
+
+// Reads templates from a JSON file holding an array of them. Every template is
+// checked to build, so that spawning from it can't fail later. Entity types
+// must be registered before.
+func LoadTemplates(filename string) (map[string]*Template, os.Error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    var list []*Template
+    if err = json.Unmarshal(data, &list); err != nil {
+        return nil, err
+    }
+    templates := make(map[string]*Template, len(list))
+    for _, t := range list {
+        if _, ok := templates[t.Name]; ok {
+            return nil, os.NewError("Duplicate template " + t.Name)
+        }
+        id, ok := entityTypes[t.Type]
+        if !ok {
+            return nil, os.NewError(t.Name + ": No entity type registered named " +
+                t.Type)
+        }
+        t.Id = id
+        if _, err = t.MakeStates(); err != nil {
+            return nil, os.NewError(t.Name + ": " + err.String())
+        }
+        if _, err = t.MakeActions(); err != nil {
+            return nil, os.NewError(t.Name + ": " + err.String())
+        }
+        templates[t.Name] = t
+    }
+    return templates, nil
+}
+
+// Creates an entity from the template. Overrides replace or add to the states
+// of the template, e.g. to spawn it at some Position.
+func (t *Template) Spawn(uid UniqueId, overrides []State) Entity {
+    // Both were checked by LoadTemplates
+    states, err := t.MakeStates()
+    if err != nil {
+        panic(err.String())
+    }
+    actions, err := t.MakeActions()
+    if err != nil {
+        panic(err.String())
+    }
+    ent := NewCmpData(uid, t.Id, t.Name)
+    for _, state := range states {
+        ent.SetState(state)
+    }
+    for _, state := range overrides {
+        ent.SetState(state)
+    }
+    for _, action := range actions {
+        ent.AddAction(action)
+    }
+    return ent
+}
+
+// Builds the initial states of the template.
+func (t *Template) MakeStates() ([]State, os.Error) {
+    states := make([]State, 0, len(t.States))
+    for name, data := range t.States {
+        id, ok := stateNames[name]
+        if !ok {
+            return nil, os.NewError("No state registered named " + name)
+        }
+        val, err := makeFromJSON(stateTypes[id], data)
+        if err != nil {
+            return nil, os.NewError(name + ": " + err.String())
+        }
+        states = append(states, val.(State))
+    }
+    return states, nil
+}
+
+// Builds the actions attached by the template.
+func (t *Template) MakeActions() ([]Action, os.Error) {
+    actions := make([]Action, 0, len(t.Actions))
+    for name, data := range t.Actions {
+        typ, ok := actionTypes[name]
+        if !ok {
+            return nil, os.NewError("No action registered named " + name)
+        }
+        val, err := makeFromJSON(typ, data)
+        if err != nil {
+            return nil, os.NewError(name + ": " + err.String())
+        }
+        actions = append(actions, val.(Action))
+    }
+    return actions, nil
+}
+
+// Creates a state or action of type t from decoded JSON. A single field is
+// given as is, several fields as an object.
+func makeFromJSON(t reflect.Type, data interface{}) (interface{}, os.Error) {
+    val, ok := reflect.MakeZero(t).(*reflect.StructValue)
+    if !ok {
+        panic("State or action is non-struct type!")
+    }
+    var err os.Error
+    switch val.NumField() {
+    case 0: // Nothing to set
+    case 1:
+        err = setFromJSON(val.Field(0), data)
+    default:
+        err = setFromJSON(val, data)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return val.Interface(), nil
+}
+
+// Sets val from a value decoded from JSON.
+func setFromJSON(val reflect.Value, data interface{}) os.Error {
+    mismatch := os.NewError(fmt.Sprintf("%v does not match %s", data,
+        val.Type()))
+    switch f := val.(type) {
+    case *reflect.BoolValue:
+        b, ok := data.(bool)
+        if !ok {
+            return mismatch
+        }
+        f.Set(b)
+    case *reflect.IntValue:
+        n, ok := data.(float64)
+        if !ok {
+            return mismatch
+        }
+        f.Set(int64(n))
+    case *reflect.UintValue:
+        n, ok := data.(float64)
+        if !ok || n < 0 {
+            return mismatch
+        }
+        f.Set(uint64(n))
+    case *reflect.FloatValue:
+        n, ok := data.(float64)
+        if !ok {
+            return mismatch
+        }
+        f.Set(n)
+    case *reflect.StringValue:
+        s, ok := data.(string)
+        if !ok {
+            return mismatch
+        }
+        f.Set(s)
+    case *reflect.SliceValue:
+        list, ok := data.([]interface{})
+        if !ok {
+            return mismatch
+        }
+        slice := reflect.MakeSlice(f.Type().(*reflect.SliceType), len(list),
+            len(list))
+        for i, elem := range list {
+            if err := setFromJSON(slice.Elem(i), elem); err != nil {
+                return err
+            }
+        }
+        f.Set(slice)
+    case *reflect.PtrValue:
+        if data == nil {
+            return nil // Leave it nil
+        }
+        elem := reflect.MakeZero(f.Type().(*reflect.PtrType).Elem())
+        if err := setFromJSON(elem, data); err != nil {
+            return err
+        }
+        f.PointTo(elem)
+    case *reflect.StructValue:
+        fields, ok := data.(map[string]interface{})
+        if !ok {
+            return mismatch
+        }
+        for name, fdata := range fields {
+            field := f.FieldByName(name)
+            if field == nil {
+                return os.NewError(fmt.Sprintf("%s has no field %s", f.Type(),
+                    name))
+            }
+            if err := setFromJSON(field, fdata); err != nil {
+                return err
+            }
+        }
+    default:
+        return os.NewError("Type not supported in templates: " +
+            val.Type().String())
+    }
+    return nil
+}
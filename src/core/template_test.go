@@ -0,0 +1,185 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package core
+
+import (
+    "io/ioutil"
+    "os"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+const testTemplates = "_test_templates.json"
+
+type tplPosition struct {
+    X, Y float64
+}
+
+func (x tplPosition) Id() StateId  { return 200 }
+func (x tplPosition) Name() string { return "TplPosition" }
+
+type tplHealth struct {
+    Health int
+}
+
+func (x tplHealth) Id() StateId  { return 201 }
+func (x tplHealth) Name() string { return "TplHealth" }
+
+type tplKills struct {
+    Kills uint
+}
+
+func (x tplKills) Id() StateId  { return 202 }
+func (x tplKills) Name() string { return "TplKills" }
+
+type tplTags struct {
+    Tags []string
+}
+
+func (x tplTags) Id() StateId  { return 203 }
+func (x tplTags) Name() string { return "TplTags" }
+
+type tplWander struct {
+    Speed  float64
+    Target *tplPosition
+}
+
+func (a tplWander) Id() ActionId { return 200 }
+func (a tplWander) Name() string { return "TplWander" }
+
+func (a tplWander) Act(ent Entity, svc ServiceContext) {}
+
+func init() {
+    RegisterState(tplPosition{})
+    RegisterState(tplHealth{})
+    RegisterState(tplKills{})
+    RegisterState(tplTags{})
+    RegisterAction(tplWander{})
+    RegisterEntity("TplMonster", 200)
+}
+
+// A template that loads, unless override replaces its Type or one of its
+// states or actions with something else, e.g. `TplHealth:"lots"`
+func monster(override string) string {
+    fields := map[string]string{
+        "Type":        `"TplMonster"`,
+        "TplPosition": `{"X": 1, "Y": 2}`,
+        "TplHealth":   `5`,
+        "TplKills":    `0`,
+        "TplTags":     `["big", "hairy"]`,
+        "TplWander":   `{"Speed": 2, "Target": {"X": 3, "Y": 4}}`,
+    }
+    if override != "" {
+        i := strings.Index(override, ":")
+        fields[override[:i]] = override[i+1:]
+    }
+    return `{"Name": "Monster", "Type": ` + fields["Type"] + `,
+        "States": {"TplPosition": ` + fields["TplPosition"] +
+        `, "TplHealth": ` + fields["TplHealth"] +
+        `, "TplKills": ` + fields["TplKills"] +
+        `, "TplTags": ` + fields["TplTags"] + `},
+        "Actions": {"TplWander": ` + fields["TplWander"] + `}}`
+}
+
+var templateTests = []struct {
+    name string
+    json string
+    ok   bool   // Whether it should load
+    err  string // Part of the expected error
+}{
+    {"valid", "[" + monster("") + "]", true, ""},
+    {"duplicate", "[" + monster("") + ", " + monster("") + "]", false,
+        "Duplicate template Monster"},
+    {"unknown type", "[" + monster(`Type:"Dragon"`) + "]", false,
+        "No entity type registered named Dragon"},
+    {"missing type", `[{"Name": "Monster", "States": {}, "Actions": {}}]`,
+        false, "No entity type registered named"},
+    {"unknown state", `[{"Name": "Monster", "Type": "TplMonster",
+        "States": {"Mana": 3}, "Actions": {}}]`, false,
+        "No state registered named Mana"},
+    {"unknown action", `[{"Name": "Monster", "Type": "TplMonster",
+        "States": {}, "Actions": {"Fly": 1}}]`, false,
+        "No action registered named Fly"},
+    {"string for int", "[" + monster(`TplHealth:"lots"`) + "]", false,
+        "does not match"},
+    {"number for string", "[" + monster(`TplTags:["big", 1.5]`) + "]", false,
+        "does not match"},
+    {"negative uint", "[" + monster(`TplKills:-1`) + "]", false,
+        "does not match"},
+    {"number for struct", "[" + monster(`TplPosition:3`) + "]", false,
+        "does not match"},
+    {"unknown field", "[" + monster(`TplPosition:{"X": 1, "Z": 2}`) + "]",
+        false, "has no field Z"},
+    {"bool for pointer", "[" + monster(`TplWander:{"Target": true}`) + "]",
+        false, "does not match"},
+    {"not json", `[{"Name": `, false, ""},
+}
+
+func TestLoadTemplates(t *testing.T) {
+    defer os.Remove(testTemplates)
+    for _, test := range templateTests {
+        data := []byte(test.json)
+        if err := ioutil.WriteFile(testTemplates, data, 0644); err != nil {
+            t.Fatalf("Could not write templates: %v", err)
+        }
+        templates, err := LoadTemplates(testTemplates)
+        switch {
+        case test.ok && err != nil:
+            t.Errorf("%s: %v", test.name, err)
+        case test.ok:
+            if tpl := templates["Monster"]; tpl == nil || tpl.Id != 200 {
+                t.Errorf("%s: template %v not loaded with its type", test.name,
+                    tpl)
+            }
+        case err == nil:
+            t.Errorf("%s: loaded, expected %q", test.name, test.err)
+        case !strings.Contains(err.String(), test.err):
+            t.Errorf("%s: error %q, expected %q", test.name, err, test.err)
+        }
+    }
+}
+
+func TestSpawn(t *testing.T) {
+    defer os.Remove(testTemplates)
+    data := []byte("[" + monster("") + "]")
+    if err := ioutil.WriteFile(testTemplates, data, 0644); err != nil {
+        t.Fatalf("Could not write templates: %v", err)
+    }
+    templates, err := LoadTemplates(testTemplates)
+    if err != nil {
+        t.Fatalf("Could not load templates: %v", err)
+    }
+    tpl := templates["Monster"]
+
+    // Overrides replace template states and add new ones
+    ent := tpl.Spawn(7, []State{tplHealth{9}, Remove{true}})
+    if ent.Uid() != 7 || ent.Id() != 200 || ent.Name() != "Monster" {
+        t.Errorf("Spawned %d %d %s", ent.Uid(), ent.Id(), ent.Name())
+    }
+    expected := []State{tplPosition{1, 2}, tplHealth{9}, tplKills{0},
+        tplTags{[]string{"big", "hairy"}}, Remove{true}}
+    for _, state := range expected {
+        if got := ent.GetState(state.Id()); !reflect.DeepEqual(got, state) {
+            t.Errorf("State %s is %v, expected %v", state.Name(), got, state)
+        }
+    }
+    wander := tplWander{2, &tplPosition{3, 4}}
+    action := ent.(*CmpData).actions[wander.Id()]
+    if !reflect.DeepEqual(action, wander) {
+        t.Errorf("Action is %v, expected %v", action, wander)
+    }
+
+    // Entities never share values
+    other := tpl.Spawn(8, nil)
+    ent.GetState(tplTags{}.Id()).(tplTags).Tags[0] = "small"
+    if tags := other.GetState(tplTags{}.Id()).(tplTags); tags.Tags[0] != "big" {
+        t.Errorf("Spawned entities share tags: %v", tags)
+    }
+    health := other.GetState(tplHealth{}.Id())
+    if !reflect.DeepEqual(health, tplHealth{5}) {
+        t.Errorf("Override applied to another entity: %v", health)
+    }
+}
@@ -6,15 +6,15 @@ package game
 
 import (
     "log"
+    "os"
     "reflect"
+    "sort"
     "time"
     .   "core"
     "pubsub"
+    "util"
 )
 
-var tick_rate int64 = 60            // Ticks per second
-var skip_ns int64 = 1e9 / tick_rate // Nanosecond interval per tick
-
 // Function that initializes the game state.
 var InitFunc func(g *Game, svc ServiceContext)
 
@@ -25,6 +25,47 @@ type MsgSpawnEntity struct {
     Reply chan Msg
 }
 
+// Requests that an entity be created from the named template, with Overrides
+// replacing or adding to its initial states. If Reply is not nil, the entity
+// descriptor will be sent back, nil if there is no such template.
+type MsgSpawnTemplate struct {
+    Template  string
+    Overrides []State
+    Reply     chan Msg
+}
+
+// Pauses the game, entities are not ticked until MsgResume or MsgStep.
+type MsgPause struct{}
+
+// Resumes a paused game.
+type MsgResume struct{}
+
+// Runs a single tick while the game is paused.
+type MsgStep struct{}
+
+// Sets how much simulated time passes per wall clock second, e.g. 0.5 runs the
+// game at half speed. Negative scales are ignored.
+type MsgSetTimeScale struct {
+    Scale float64
+}
+
+// Sets the number of ticks per second. Rates <= 0 are ignored.
+type MsgSetTickRate struct {
+    Rate int64
+}
+
+// What Game does with an entity that misses the tick deadline.
+type TimeoutPolicy int
+
+const (
+    // Leave the entity out of ticks until it answers the one it missed
+    SkipLate TimeoutPolicy = iota
+    // Never tick the entity again, but leave it in the game
+    QuarantineLate
+    // Remove the entity from the game
+    RemoveLate
+)
+
 // Manages game data and runs the main loop.
 type Game struct {
     *HandlerQueue
@@ -32,13 +73,37 @@ type Game struct {
     ents    map[chan Msg]Entity
     nextUid UniqueId
     input   chan Msg
+    // Entities that missed a tick and have not answered it yet
+    late map[chan Msg]bool
+    // Entities that are never ticked again
+    quarantined map[chan Msg]bool
+    // Nanoseconds to wait for all entities to answer a tick, forever if <= 0
+    // or in deterministic mode
+    TickTimeout int64
+    // What to do with entities that miss the tick deadline
+    OnTimeout TimeoutPolicy
+    // Ticks per second
+    TickRate int64
+    // Simulated seconds per wall clock second
+    TimeScale float64
+    // Number of the last tick run
+    tick   uint64
+    paused bool
+    steps  int // Ticks to run while paused
+    // If set, the game is loaded from this snapshot instead of calling
+    // InitFunc when the file exists, and saved to it on shutdown
+    SnapshotFile string
+    // Entity templates by name, see MsgSpawnTemplate
+    Templates map[string]*Template
 }
 
 func NewGame(svc ServiceContext) *Game {
     var uid UniqueId = 0 // Game uid is always zero
     ents := make(map[chan Msg]Entity)
     hq := NewHandlerQueue()
-    return &Game{hq, svc, ents, uid + 1, nil}
+    return &Game{hq, svc, ents, uid + 1, nil, make(map[chan Msg]bool),
+        make(map[chan Msg]bool), 1e9, SkipLate, 60, 1, 0, false, 0, "",
+        make(map[string]*Template)}
 }
 
 func (g *Game) Chan() chan Msg { return g.input }
@@ -46,53 +111,170 @@ func (g *Game) Chan() chan Msg { return g.input }
 func (g *Game) Run(input chan Msg) {
     g.input = input
     g.waitOnServiceStart(input)
-    InitFunc(g, g.svc)
+    g.init()
 
-    // List of up to date entities
-    updated := make(map[chan Msg]bool, len(g.ents))
     remove_list := []chan Msg{}
-    tick_msg := MsgTick{input}
+    crashed := []chan Msg{}
+    saves := []MsgSaveSnapshot{}
+    var quit *MsgQuit // Set once shutdown has been requested
 
     for {
         tick_start := time.Nanoseconds()
+        running := !g.paused || g.steps > 0
+        tick_msg := MsgTick{Origin: input}
+        if running {
+            if g.paused {
+                g.steps--
+            }
+            g.tick++
+            dt := g.TimeScale / float64(g.TickRate)
+            tick_msg = MsgTick{input, g.tick, dt, tick_start}
+        }
 
-        // Tell all the entities that a new tick has started
-        ent_num := len(g.ents) // Store ent count for *this* tick
-        for ent := range g.ents {
-            Send(g, ent, tick_msg)
+        // Tell all the entities that a new tick has started. In deterministic
+        // mode they are told one at a time, the next once the previous one
+        // has updated.
+        var order []chan Msg
+        if running {
+            order = g.tickOrder()
+        }
+        ticking := make(map[chan Msg]bool, len(order)) // Entities in *this* tick
+        for _, ent := range order {
+            ticking[ent] = true
+        }
+        var deadline <-chan int64 // Never fires if nil
+        if running { // Paused, just wait for messages
+            deadline = g.deadline()
         }
+        sent := make(map[chan Msg]bool, len(order))
+        var current chan Msg // Last one sent the tick
+        tickNext := func() {
+            for len(sent) < len(order) {
+                current = order[len(sent)]
+                if !g.sendBefore(current, tick_msg, deadline) {
+                    // Still busy with something else. It gets the tick once
+                    // it's done and is late until it answers.
+                    util.SendAsync(current, tick_msg)
+                }
+                sent[current] = true
+                if g.svc.Deterministic {
+                    return
+                }
+            }
+        }
+        tickNext()
+        // List of up to date entities
+        updated := make(map[chan Msg]bool, len(ticking))
 
         // Listen for any service messages
         // Break out of loop once all entities have updated
-        for {
-            msg := g.GetMsg(input)
+        for len(updated) < len(ticking) || len(ticking) == 0 {
+            msg, ok := g.GetMsgOrTimeout(input, deadline)
+            if !ok {
+                g.handleLate(sent, updated)
+                break
+            }
             switch m := msg.(type) {
             case MsgTick:
-                updated[m.Origin] = true // bool value doesn't matter
-                if len(updated) == ent_num {
-                    // Clear out list, use current number of entities for next tick
-                    updated = make(map[chan Msg]bool, len(g.ents))
-                    goto update_end
+                if g.late[m.Origin] { // Answer to a missed tick, caught up
+                    g.late[m.Origin] = false, false
+                } else if ticking[m.Origin] {
+                    // Restarted services announce themselves again, those
+                    // are not counted
+                    updated[m.Origin] = true // bool value doesn't matter
+                    if m.Origin == current {
+                        tickNext()
+                    }
                 }
             case MsgEntityRemoved: // TODO: Counts as imperative here, fix?
                 remove_list = append(remove_list, m.Entity.Chan)
+            case MsgEntityCrashed:
+                // It won't answer this tick, so count it as updated
+                if ticking[m.Entity.Chan] {
+                    updated[m.Entity.Chan] = true
+                    if m.Entity.Chan == current {
+                        tickNext()
+                    }
+                }
+                if _, ok := g.ents[m.Entity.Chan]; ok {
+                    remove_list = append(remove_list, m.Entity.Chan)
+                }
+                crashed = append(crashed, m.Entity.Chan)
             case MsgListEntities:
                 Send(g, m.Reply, g.makeEntityList())
             case MsgSpawnEntity:
                 g.spawnEntity(m)
+            case MsgSpawnTemplate:
+                g.spawnTemplate(m)
+            case MsgSaveSnapshot: // Entities are consistent once it's over
+                saves = append(saves, m)
+            case MsgQuit: // Finish the current tick first
+                quit = &m
+            case MsgPause:
+                g.paused = true
+            case MsgResume:
+                g.paused = false
+                g.steps = 0
+            case MsgStep:
+                if g.paused {
+                    g.steps++
+                }
+            case MsgSetTimeScale:
+                if m.Scale >= 0 {
+                    g.TimeScale = m.Scale
+                }
+            case MsgSetTickRate:
+                if m.Rate > 0 {
+                    g.TickRate = m.Rate
+                }
+            }
+            if len(ticking) == 0 {
+                break // Nothing to wait for, one message is enough
             }
         }
-    update_end:
-        Send(g, g.svc.Comm, tick_msg)
+        if running {
+            g.tickComm(tick_msg)
+        }
 
         // Remove all entities that reported themselves to be removed
-        for _, ent := range remove_list {
-            g.RemoveEntity(g.ents[ent])
+        for _, ch := range remove_list {
+            if ent, ok := g.ents[ch]; ok { // May be reported more than once
+                g.RemoveEntity(ent)
+            }
         }
         if len(remove_list) > 0 { // Clear out list if needed
             remove_list = []chan Msg{}
         }
+        // Crashed entities linger until told to quit
+        for _, ch := range crashed {
+            Stop(g, ch)
+        }
+        if len(crashed) > 0 {
+            crashed = []chan Msg{}
+        }
+        for _, save := range saves {
+            err := g.saveSnapshot(save.Filename)
+            if err != nil {
+                log.Println("game: could not save snapshot:", err)
+            }
+            if save.Reply != nil {
+                Send(g, save.Reply, err)
+            }
+        }
+        if len(saves) > 0 {
+            saves = []MsgSaveSnapshot{}
+        }
 
+        if quit != nil {
+            g.shutdown()
+            AckQuit(g, *quit)
+            return
+        }
+
+        if !running {
+            continue // Nothing to keep time for
+        }
+        skip_ns := 1e9 / g.TickRate // Nanosecond interval per tick
         sleep_ns := (tick_start + skip_ns) - time.Nanoseconds()
         if sleep_ns > 0 {
             time.Sleep(sleep_ns)
@@ -102,6 +284,20 @@ func (g *Game) Run(input chan Msg) {
     }
 }
 
+// Loads SnapshotFile if it exists, otherwise calls InitFunc. A snapshot that
+// can't be loaded is fatal, the game would overwrite it on shutdown.
+func (g *Game) init() {
+    if g.SnapshotFile != "" {
+        if _, err := os.Stat(g.SnapshotFile); err == nil {
+            if err = g.loadSnapshot(g.SnapshotFile); err != nil {
+                log.Fatal("game: could not load snapshot: ", err)
+            }
+            return
+        }
+    }
+    InitFunc(g, g.svc)
+}
+
 func (g *Game) AddEntity(ent Entity) {
     g.ents[ent.Chan()] = ent
     msg := MsgEntityAdded{NewEntityDesc(ent)}
@@ -110,6 +306,8 @@ func (g *Game) AddEntity(ent Entity) {
 
 func (g *Game) RemoveEntity(ent Entity) {
     g.ents[ent.Chan()] = nil, false
+    g.late[ent.Chan()] = false, false
+    g.quarantined[ent.Chan()] = false, false
     msg := MsgEntityRemoved{NewEntityDesc(ent)}
     Send(g, g.svc.PubSub, pubsub.PublishMsg{"entity", msg})
 }
@@ -125,6 +323,181 @@ func (g *Game) makeEntityList() MsgListEntities {
     return MsgListEntities{nil, list}
 }
 
+// Returns the entities to tick this tick. In deterministic mode they are
+// sorted by uid and followed by PubSub and World, so that whatever the
+// entities started is finished before the tick ends.
+func (g *Game) tickOrder() []chan Msg {
+    ents := make([]Entity, 0, len(g.ents))
+    for ch, ent := range g.ents {
+        if !g.late[ch] && !g.quarantined[ch] {
+            ents = append(ents, ent)
+        }
+    }
+    if g.svc.Deterministic {
+        sort.Sort(byUid(ents))
+    }
+    order := make([]chan Msg, len(ents), len(ents)+2)
+    for i, ent := range ents {
+        order[i] = ent.Chan()
+    }
+    if g.svc.Deterministic {
+        order = append(order, g.svc.PubSub, g.svc.World)
+    }
+    return order
+}
+
+// Sorts entities by uid
+type byUid []Entity
+
+func (l byUid) Len() int           { return len(l) }
+func (l byUid) Less(i, j int) bool { return l[i].Uid() < l[j].Uid() }
+func (l byUid) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Tells Comm that the tick is over. In deterministic mode this waits until
+// Comm has handed over the client input for the next tick.
+func (g *Game) tickComm(tick MsgTick) {
+    if !g.svc.Deterministic {
+        Send(g, g.svc.Comm, tick)
+        return
+    }
+    reply := make(chan Msg)
+    tick.Origin = reply
+    Send(g, g.svc.Comm, tick)
+    // Clients are started while Game waits here, so their entities are
+    // spawned at the same point on every run
+    for {
+        select {
+        case <-reply:
+            return
+        case msg := <-g.input:
+            switch m := msg.(type) {
+            case MsgSpawnEntity:
+                g.spawnEntity(m)
+            case MsgSpawnTemplate:
+                g.spawnTemplate(m)
+            case MsgListEntities:
+                Send(g, m.Reply, g.makeEntityList())
+            default:
+                g.HandleMsg(msg)
+            }
+        }
+    }
+}
+
+// Returns a channel that is closed once TickTimeout has passed, so that every
+// receive from it fires from then on. Returns nil, which never fires, if
+// TickTimeout <= 0 or in deterministic mode, where the outcome must not depend
+// on how fast the machine is.
+func (g *Game) deadline() <-chan int64 {
+    if g.TickTimeout <= 0 || g.svc.Deterministic {
+        return nil
+    }
+    ch := make(chan int64)
+    go func(timeout int64) {
+        time.Sleep(timeout)
+        close(ch)
+    }(g.TickTimeout)
+    return ch
+}
+
+// Like Send, but gives up once deadline fires. Returns whether msg was sent.
+func (g *Game) sendBefore(ch chan Msg, msg Msg, deadline <-chan int64) bool {
+    for {
+        select {
+        case ch <- msg:
+            return true
+        case m := <-g.input:
+            g.HandleMsg(m)
+        case <-deadline:
+            return false
+        }
+    }
+    return false // Never reached
+}
+
+// Like Recv, but gives up once deadline fires.
+func (g *Game) recvBefore(ch chan Msg, deadline <-chan int64) (Msg, bool) {
+    for {
+        select {
+        case msg := <-ch:
+            return msg, true
+        case m := <-g.input:
+            g.HandleMsg(m)
+        case <-deadline:
+            return nil, false
+        }
+    }
+    return nil, false // Never reached
+}
+
+// Like Stop, but gives up on entities that don't quit within TickTimeout.
+// Returns whether the entity acknowledged quitting.
+func (g *Game) stopEntity(ch chan Msg) bool {
+    deadline := g.deadline()
+    reply := make(chan Msg, 1) // Can still be answered once given up on
+    if !g.sendBefore(ch, MsgQuit{reply}, deadline) {
+        util.SendAsync(ch, MsgQuit{})
+        return false
+    }
+    _, ok := g.recvBefore(reply, deadline)
+    return ok
+}
+
+// Reports the entities that did not answer the current tick in time and deals
+// with them according to OnTimeout.
+func (g *Game) handleLate(sent, updated map[chan Msg]bool) {
+    for ch := range sent {
+        if updated[ch] {
+            continue
+        }
+        ent, ok := g.ents[ch]
+        if !ok {
+            continue
+        }
+        log.Printf("game: entity %d (%s) missed the tick deadline", ent.Uid(),
+            ent.Name())
+        switch g.OnTimeout {
+        case SkipLate:
+            g.late[ch] = true
+        case QuarantineLate:
+            log.Printf("game: quarantining entity %d (%s)", ent.Uid(), ent.Name())
+            g.quarantined[ch] = true
+        case RemoveLate:
+            log.Printf("game: removing entity %d (%s)", ent.Uid(), ent.Name())
+            g.RemoveEntity(ent)
+            util.SendAsync(ch, MsgQuit{}) // In case it ever recovers
+        }
+    }
+}
+
+// Stops everything in order: clients are disconnected first so no more input
+// arrives, then every entity is stopped and finally the remaining services.
+// Each one has acknowledged quitting by the time this returns.
+func (g *Game) shutdown() {
+    log.Println("game: shutting down")
+    Stop(g, g.svc.Comm)
+    if g.SnapshotFile != "" { // No more input, the world is final
+        if err := g.saveSnapshot(g.SnapshotFile); err != nil {
+            log.Println("game: could not save snapshot:", err)
+        }
+    }
+    for ent := range g.ents {
+        if g.late[ent] || g.quarantined[ent] {
+            util.SendAsync(ent, MsgQuit{}) // May never answer, don't wait
+            continue
+        }
+        if !g.stopEntity(ent) {
+            e := g.ents[ent]
+            log.Printf("game: entity %d (%s) did not quit in time", e.Uid(),
+                e.Name())
+        }
+    }
+    Stop(g, g.svc.World)
+    Stop(g, g.svc.Login)
+    Stop(g, g.svc.PubSub) // Last, everything above may still publish
+    log.Println("game: shut down")
+}
+
 // Returns the next available unique id
 func (g *Game) GetUid() UniqueId {
     uid := g.nextUid
@@ -134,22 +507,25 @@ func (g *Game) GetUid() UniqueId {
 
 // Returns once all services have signalled that they have started.
 // Automatically accounts for a variable number of services as contained in the
-// ServiceContext struct.
-//
-// TODO: This implementation is prone to error if the same service sends
-// MsgTick more than once, fix?
+// ServiceContext struct. A service that restarts before the game has started
+// is only counted once.
 func (g *Game) waitOnServiceStart(input chan Msg) {
     // We can discard the ok value, because svc is always a struct
     val, _ := (reflect.NewValue(g.svc)).(*reflect.StructValue)
-    svc_num := val.NumField() - 1 // Don't count Game
-    num_left := svc_num
+    svc_num := -1 // Don't count Game
+    for i := 0; i < val.NumField(); i++ {
+        if _, ok := val.Field(i).(*reflect.ChanValue); ok {
+            svc_num++ // Only channels are services
+        }
+    }
+    started := make(map[chan Msg]bool, svc_num)
 
     for {
         msg := <-input
         switch m := msg.(type) {
         case MsgTick:
-            num_left--
-            if num_left == 0 {
+            started[m.Origin] = true
+            if len(started) == svc_num {
                 goto done
             }
         default:
@@ -162,10 +538,36 @@ done:
 // Creates a new player entity for a requesting client
 func (g *Game) spawnEntity(msg MsgSpawnEntity) {
     p := msg.Spawn(g.GetUid())
-    g.AddEntity(p)
-    go p.Run(g.svc)
+    g.startEntity(p)
     if msg.Reply != nil {
         desc := NewEntityDesc(p)
         Send(g, msg.Reply, desc)
     }
 }
+
+// Creates an entity from the named template for a requesting service
+func (g *Game) spawnTemplate(msg MsgSpawnTemplate) {
+    desc := g.SpawnTemplate(msg.Template, msg.Overrides)
+    if msg.Reply != nil {
+        Send(g, msg.Reply, desc)
+    }
+}
+
+// Creates an entity from the named template and adds it to the game. Returns
+// nil if there is no such template.
+func (g *Game) SpawnTemplate(name string, overrides []State) *EntityDesc {
+    t, ok := g.Templates[name]
+    if !ok {
+        log.Println("game: no entity template named", name)
+        return nil
+    }
+    ent := t.Spawn(g.GetUid(), overrides)
+    g.startEntity(ent)
+    return NewEntityDesc(ent)
+}
+
+// Adds an entity to the game and starts it
+func (g *Game) startEntity(ent Entity) {
+    g.AddEntity(ent)
+    go SuperviseEntity(ent, g.svc)
+}
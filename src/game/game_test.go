@@ -0,0 +1,204 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package game
+
+import (
+    "testing"
+    "time"
+    .   "core"
+)
+
+// Nanoseconds tests wait for something to happen before failing
+const patience = 1e9
+
+// An entity that only answers ticks. While busy it handles no messages at all,
+// as if it were stuck in some action outside its tick.
+type testEntity struct {
+    *CmpData
+    input chan Msg
+    busy  chan bool   // A value makes the entity busy, the next one frees it
+    ticks chan uint64 // Ticks the entity answered, dropped once full
+}
+
+func newTestEntity(uid UniqueId) *testEntity {
+    return &testEntity{NewCmpData(uid, 0, "Test"), make(chan Msg),
+        make(chan bool), make(chan uint64, 1000)}
+}
+
+func (e *testEntity) Chan() chan Msg { return e.input }
+
+func (e *testEntity) Run(svc ServiceContext) {
+    for {
+        select {
+        case <-e.busy:
+            <-e.busy
+        case msg := <-e.input:
+            switch m := msg.(type) {
+            case MsgTick:
+                select {
+                case e.ticks <- m.Tick:
+                default:
+                }
+                m.Origin <- MsgTick{Origin: e.input}
+            case MsgQuit:
+                if m.Reply != nil {
+                    m.Reply <- MsgQuit{}
+                }
+                return
+            }
+        }
+    }
+}
+
+// Waits for the entity to answer a tick after tick and returns its number
+func (e *testEntity) waitTick(t *testing.T, after uint64) uint64 {
+    timeout := time.After(patience)
+    for {
+        select {
+        case tick := <-e.ticks:
+            if tick > after {
+                return tick
+            }
+        case <-timeout:
+            t.Fatalf("Entity %d not ticked after tick %d", e.Uid(), after)
+        }
+    }
+    return 0 // Never reached
+}
+
+// Stands in for a service: announces itself to Game, then swallows everything
+// until it is told to quit.
+func fakeService(game, input chan Msg) {
+    game <- MsgTick{Origin: input}
+    for {
+        if m, ok := (<-input).(MsgQuit); ok {
+            if m.Reply != nil {
+                m.Reply <- MsgQuit{}
+            }
+            return
+        }
+    }
+}
+
+// Runs a game with fake services and the passed entities
+func startGame(policy TimeoutPolicy, ents ...Entity) *Game {
+    svc := NewServiceContext()
+    for _, ch := range []chan Msg{svc.Comm, svc.PubSub, svc.World, svc.Login} {
+        go fakeService(svc.Game, ch)
+    }
+    g := NewGame(svc)
+    g.TickTimeout = 2e7 // 20 ms
+    g.TickRate = 100
+    g.OnTimeout = policy
+    InitFunc = func(g *Game, svc ServiceContext) {
+        for _, ent := range ents {
+            g.startEntity(ent)
+        }
+    }
+    go g.Run(svc.Game)
+    return g
+}
+
+// Shuts the game down, failing if that takes too long
+func stopGame(t *testing.T, g *Game) {
+    reply := make(chan Msg)
+    g.svc.Game <- MsgQuit{reply}
+    select {
+    case <-reply:
+    case <-time.After(patience):
+        t.Fatalf("Game did not shut down")
+    }
+}
+
+// Starts a game with a healthy and a stuck entity and returns them once the
+// stuck one has missed a tick and the healthy one was ticked without it.
+// Returns the last tick the stuck one answered.
+func startWithStuck(t *testing.T, policy TimeoutPolicy) (g *Game,
+healthy, stuck *testEntity, last uint64) {
+    healthy, stuck = newTestEntity(1), newTestEntity(2)
+    g = startGame(policy, healthy, stuck)
+    last = stuck.waitTick(t, 0)
+    stuck.busy <- true
+    // It may have answered another tick before it got busy
+    for drained := false; !drained; {
+        select {
+        case last = <-stuck.ticks:
+        default:
+            drained = true
+        }
+    }
+    // The next tick is missed, the healthy one goes on without it
+    tick := healthy.waitTick(t, last+1)
+    healthy.waitTick(t, tick+2)
+    return
+}
+
+var oldInitFunc = InitFunc
+
+func TestSkipLate(t *testing.T) {
+    defer func() { InitFunc = oldInitFunc }()
+    g, _, stuck, last := startWithStuck(t, SkipLate)
+
+    // Once it answers the missed tick it is ticked again
+    stuck.busy <- true
+    missed := stuck.waitTick(t, last)
+    stuck.waitTick(t, missed)
+    stopGame(t, g)
+    if len(g.late) > 0 || len(g.quarantined) > 0 {
+        t.Errorf("Entity still late after catching up")
+    }
+    if _, ok := g.ents[stuck.Chan()]; !ok {
+        t.Errorf("Late entity removed")
+    }
+}
+
+func TestQuarantineLate(t *testing.T) {
+    defer func() { InitFunc = oldInitFunc }()
+    g, healthy, stuck, last := startWithStuck(t, QuarantineLate)
+
+    // The missed tick still arrives, but no other
+    stuck.busy <- true
+    missed := stuck.waitTick(t, last)
+    tick := healthy.waitTick(t, missed)
+    healthy.waitTick(t, tick+3)
+    select {
+    case tick := <-stuck.ticks:
+        t.Errorf("Quarantined entity got tick %d", tick)
+    default:
+    }
+    stopGame(t, g)
+    if !g.quarantined[stuck.Chan()] {
+        t.Errorf("Entity not quarantined")
+    }
+    if _, ok := g.ents[stuck.Chan()]; !ok {
+        t.Errorf("Quarantined entity removed")
+    }
+}
+
+func TestRemoveLate(t *testing.T) {
+    defer func() { InitFunc = oldInitFunc }()
+    g, _, stuck, _ := startWithStuck(t, RemoveLate)
+    stopGame(t, g) // Doesn't wait on the removed entity
+    if _, ok := g.ents[stuck.Chan()]; ok {
+        t.Errorf("Late entity not removed")
+    }
+    if len(g.late) > 0 || len(g.quarantined) > 0 {
+        t.Errorf("Removed entity still tracked")
+    }
+    stuck.busy <- true // Gets the missed tick and quits
+}
+
+// An entity busy outside its tick must not keep the game from shutting down
+func TestShutdownBusyEntity(t *testing.T) {
+    defer func() { InitFunc = oldInitFunc }()
+    busy := newTestEntity(1)
+    g := startGame(SkipLate, busy)
+    busy.waitTick(t, 0)
+    g.svc.Game <- MsgPause{}
+    time.Sleep(5e7) // 50 ms, the paused game stops ticking
+    busy.busy <- true
+    stopGame(t, g)
+    busy.busy <- true
+}
@@ -0,0 +1,193 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package game
+
+import (
+    "bufio"
+    "gob"
+    "log"
+    "os"
+    "sort"
+    .   "core"
+)
+
+// Version of the snapshot format, bumped whenever it changes incompatibly.
+const snapshotVersion = 1
+
+// Requests that the game be saved to Filename at the end of the current tick.
+type MsgSaveSnapshot struct {
+    Filename string
+    Reply    chan Msg // Reply type is os.Error, nil on success. May be nil.
+}
+
+// The header of a snapshot file, followed by the snapshot itself
+type snapshotHeader struct {
+    Version int
+}
+
+type snapshot struct {
+    NextUid  UniqueId
+    Entities []*entitySnapshot // Sorted by uid
+}
+
+type entitySnapshot struct {
+    Id     EntityId
+    Uid    UniqueId
+    Name   string
+    States []State // Sorted by id
+}
+
+// Saves every entity spawned from a template that isn't Transient, along with
+// its states. Entities are rebuilt from the same template when the snapshot is
+// loaded, with the saved states replacing those of the template. The types of
+// the states must be registered with RegisterState.
+func (g *Game) saveSnapshot(filename string) os.Error {
+    snap := &snapshot{g.nextUid, nil}
+    ents := make([]Entity, 0, len(g.ents))
+    for ch, ent := range g.ents {
+        if t, ok := g.Templates[ent.Name()]; !ok || t.Transient {
+            continue
+        }
+        if g.late[ch] || g.quarantined[ch] {
+            log.Printf("game: entity %d (%s) is not responding, not saved",
+                ent.Uid(), ent.Name())
+            continue
+        }
+        ents = append(ents, ent)
+    }
+    sort.Sort(byUid(ents))
+    for _, ent := range ents {
+        // Crashed entities have no states left, removed ones are gone anyway
+        saved := g.snapshotEntity(ent)
+        if saved == nil {
+            log.Printf("game: entity %d (%s) did not answer in time, not saved",
+                ent.Uid(), ent.Name())
+        } else if saved.alive() {
+            snap.Entities = append(snap.Entities, saved)
+        }
+    }
+
+    // Written next to the old snapshot and then moved over it, so that the
+    // old one survives if anything goes wrong on the way
+    tmp := filename + ".tmp"
+    if err := writeSnapshot(tmp, snap); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if err := os.Rename(tmp, filename); err != nil {
+        return err
+    }
+    log.Printf("game: saved %d entities to %s", len(snap.Entities), filename)
+    return nil
+}
+
+// Writes snap to filename and makes sure it is on disk.
+func writeSnapshot(filename string, snap *snapshot) os.Error {
+    file, err := os.Open(filename, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(file)
+    enc := gob.NewEncoder(w)
+    if err = enc.Encode(&snapshotHeader{snapshotVersion}); err == nil {
+        err = enc.Encode(snap)
+    }
+    if err == nil {
+        err = w.Flush()
+    }
+    if err == nil {
+        err = file.Sync()
+    }
+    if cerr := file.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// Collects the states of ent. Entities are idle between ticks, so they are
+// consistent with each other. Returns nil if the entity does not answer
+// within TickTimeout.
+func (g *Game) snapshotEntity(ent Entity) *entitySnapshot {
+    deadline := g.deadline()
+    reply := make(chan Msg)
+    if !g.sendBefore(ent.Chan(), MsgGetAllStates{reply}, deadline) {
+        return nil
+    }
+    states := []State{}
+    for {
+        msg, ok := g.recvBefore(reply, deadline)
+        if !ok {
+            go func() { // Let the entity finish once it gets to it
+                for _ = range reply {
+                }
+            }()
+            return nil
+        }
+        state, ok := msg.(State)
+        if !ok { // Closed, that was all of them
+            break
+        }
+        states = append(states, state)
+    }
+    sort.Sort(byStateId(states))
+    return &entitySnapshot{ent.Id(), ent.Uid(), ent.Name(), states}
+}
+
+// Whether the entity is worth saving
+func (e *entitySnapshot) alive() bool {
+    for _, state := range e.States {
+        if r, ok := state.(Remove); ok && r.Remove {
+            return false
+        }
+    }
+    return len(e.States) > 0
+}
+
+// Sorts states by id
+type byStateId []State
+
+func (l byStateId) Len() int           { return len(l) }
+func (l byStateId) Less(i, j int) bool { return l[i].Id() < l[j].Id() }
+func (l byStateId) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Reads a snapshot and spawns its entities with their saved uids and states.
+// Nothing is spawned unless the whole snapshot could be read.
+func (g *Game) loadSnapshot(filename string) os.Error {
+    file, err := os.Open(filename, os.O_RDONLY, 0)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    dec := gob.NewDecoder(bufio.NewReader(file))
+    var header snapshotHeader
+    if err = dec.Decode(&header); err != nil {
+        return err
+    }
+    if header.Version != snapshotVersion {
+        return os.NewError("Unsupported snapshot version")
+    }
+    snap := new(snapshot)
+    if err = dec.Decode(snap); err != nil {
+        return err
+    }
+    for _, saved := range snap.Entities {
+        if t, ok := g.Templates[saved.Name]; !ok || t.Id != saved.Id {
+            return os.NewError("No entity template for " + saved.Name)
+        }
+    }
+
+    for _, saved := range snap.Entities {
+        ent := g.Templates[saved.Name].Spawn(saved.Uid, saved.States)
+        g.startEntity(ent)
+        if saved.Uid >= g.nextUid {
+            g.nextUid = saved.Uid + 1
+        }
+    }
+    if snap.NextUid > g.nextUid {
+        g.nextUid = snap.NextUid
+    }
+    log.Printf("game: loaded %d entities from %s", len(snap.Entities), filename)
+    return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package login
+
+import (
+    "bufio"
+    "crypto/sha256"
+    crand "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+const saltBytes = 16 // Length of the random salt given to each account
+
+// A single account that may log in to the server. Passwords are never stored,
+// only a salted hash of them.
+type Account struct {
+    Name   string
+    Salt   string // Hex encoded random salt
+    Hash   string // Hex encoded sha256(salt + password)
+    Banned bool
+}
+
+// Checks whether the passed password matches the one of this account. The
+// hashes are compared in constant time, so timing tells nothing about them.
+func (acc *Account) CheckPassword(password string) bool {
+    hash := []byte(hashPassword(acc.Salt, password))
+    stored := []byte(acc.Hash)
+    if len(hash) != len(stored) { // Only if the account file is corrupt
+        return false
+    }
+    return subtle.ConstantTimeCompare(hash, stored) == 1
+}
+
+// Holds all known accounts. If the store was loaded from a file, the file is
+// kept up to date by Save.
+//
+// The file contains one account per line in the form:
+//     name:salt:hash:flags
+// where flags is either empty or "banned". Empty lines and lines starting with
+// '#' are ignored.
+type AccountStore struct {
+    filename string
+    accounts map[string]*Account
+}
+
+// Creates an empty store that is only kept in memory.
+func NewAccountStore() *AccountStore {
+    return &AccountStore{"", make(map[string]*Account)}
+}
+
+// Loads the accounts in filename. A missing file is not an error, the store
+// simply starts out empty and the file is created on the first Save.
+func LoadAccountStore(filename string) (*AccountStore, os.Error) {
+    as := NewAccountStore()
+    as.filename = filename
+
+    file, err := os.Open(filename, os.O_RDONLY, 0)
+    if err != nil {
+        if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+            return as, nil
+        }
+        return nil, err
+    }
+    defer file.Close()
+
+    r := bufio.NewReader(file)
+    for line_num := 1; ; line_num++ {
+        line, err := r.ReadString('\n')
+        if err != nil && err != os.EOF {
+            return nil, err
+        }
+        line = strings.TrimSpace(line)
+        if line != "" && line[0] != '#' {
+            acc, perr := parseAccount(line)
+            if perr != nil {
+                return nil, os.NewError(fmt.Sprintf("%s:%d: %s", filename,
+                    line_num, perr))
+            }
+            as.accounts[acc.Name] = acc
+        }
+        if err == os.EOF {
+            break
+        }
+    }
+    return as, nil
+}
+
+func parseAccount(line string) (*Account, os.Error) {
+    fields := strings.Split(line, ":", -1)
+    if len(fields) != 4 {
+        return nil, os.NewError("expected name:salt:hash:flags")
+    }
+    acc := &Account{Name: fields[0], Salt: fields[1], Hash: fields[2]}
+    switch fields[3] {
+    case "":
+    case "banned":
+        acc.Banned = true
+    default:
+        return nil, os.NewError("unknown account flag " + fields[3])
+    }
+    return acc, nil
+}
+
+// Writes all accounts back to the file they were loaded from. Does nothing for
+// stores that only live in memory.
+func (as *AccountStore) Save() os.Error {
+    if as.filename == "" {
+        return nil
+    }
+    file, err := os.Open(as.filename, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    w := bufio.NewWriter(file)
+    for _, acc := range as.accounts {
+        flags := ""
+        if acc.Banned {
+            flags = "banned"
+        }
+        fmt.Fprintf(w, "%s:%s:%s:%s\n", acc.Name, acc.Salt, acc.Hash, flags)
+    }
+    return w.Flush()
+}
+
+// Returns the named account or nil if there is none.
+func (as *AccountStore) Get(name string) *Account {
+    return as.accounts[name]
+}
+
+// Creates a new account with a freshly salted password hash. Fails if the
+// name is already taken or cannot be stored.
+func (as *AccountStore) Add(name, password string) (*Account, os.Error) {
+    if _, ok := as.accounts[name]; ok {
+        return nil, os.NewError("account already exists: " + name)
+    }
+    if name == "" || strings.IndexAny(name, ":\n") >= 0 {
+        return nil, os.NewError("invalid account name: " + name)
+    }
+
+    salt := make([]byte, saltBytes)
+    if _, err := io.ReadFull(crand.Reader, salt); err != nil {
+        return nil, err
+    }
+    acc := &Account{Name: name, Salt: hex.EncodeToString(salt)}
+    acc.Hash = hashPassword(acc.Salt, password)
+    as.accounts[name] = acc
+    return acc, nil
+}
+
+// Bans or unbans the named account. Returns false if there is no such account.
+func (as *AccountStore) SetBanned(name string, banned bool) bool {
+    acc, ok := as.accounts[name]
+    if ok {
+        acc.Banned = banned
+    }
+    return ok
+}
+
+func hashPassword(salt, password string) string {
+    h := sha256.New()
+    h.Write([]byte(salt))
+    h.Write([]byte(password))
+    return hex.EncodeToString(h.Sum())
+}
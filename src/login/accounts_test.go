@@ -0,0 +1,66 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package login
+
+import (
+    "os"
+    "testing"
+)
+
+const testFile = "_test_accounts.txt"
+
+func TestPasswordCheck(t *testing.T) {
+    as := NewAccountStore()
+    acc, err := as.Add("Tester", "secret")
+    if err != nil {
+        t.Fatalf("Could not add account: %v", err)
+    }
+    if !acc.CheckPassword("secret") {
+        t.Errorf("Correct password rejected")
+    }
+    if acc.CheckPassword("Secret") {
+        t.Errorf("Wrong password accepted")
+    }
+    corrupt := &Account{"Broken", acc.Salt, "abc", false}
+    if corrupt.CheckPassword("secret") {
+        t.Errorf("Password accepted for a truncated hash")
+    }
+    if acc.Hash == "secret" || acc.Salt == "" {
+        t.Errorf("Password not salted and hashed")
+    }
+    if _, err := as.Add("Tester", "other"); err == nil {
+        t.Errorf("Duplicate account added")
+    }
+}
+
+// Accounts should survive a save and load unchanged
+func TestSaveAndLoad(t *testing.T) {
+    defer os.Remove(testFile)
+    as, err := LoadAccountStore(testFile)
+    if err != nil {
+        t.Fatalf("Loading a missing file failed: %v", err)
+    }
+    as.Add("Tester", "secret")
+    as.Add("Troll", "hunter2")
+    as.SetBanned("Troll", true)
+    if err := as.Save(); err != nil {
+        t.Fatalf("Save failed: %v", err)
+    }
+
+    loaded, err := LoadAccountStore(testFile)
+    if err != nil {
+        t.Fatalf("Load failed: %v", err)
+    }
+    for _, name := range []string{"Tester", "Troll"} {
+        orig, acc := as.Get(name), loaded.Get(name)
+        if acc == nil {
+            t.Fatalf("Account %s not loaded", name)
+        }
+        if orig.Salt != acc.Salt || orig.Hash != acc.Hash ||
+            orig.Banned != acc.Banned {
+            t.Errorf("Account %s changed: %v != %v", name, *orig, *acc)
+        }
+    }
+}
@@ -0,0 +1,123 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+// Login service. Authenticates clients against an account store and keeps
+// track of who is currently logged in.
+package login
+
+import (
+    "log"
+    "os"
+    .   "core"
+    "protocol"
+)
+
+// Requests that a client be logged in. A MsgLoginResult is sent to Reply.
+type MsgLogin struct {
+    Name      string
+    AuthToken string
+    Reply     chan Msg
+}
+
+// Result of a login attempt. Reason is one of the protocol.LoginResult
+// reasons and is ACCEPTED on success.
+type MsgLoginResult struct {
+    Succeeded bool
+    Reason    int32
+}
+
+// Signals that a logged in client has disconnected and its slot is free again.
+type MsgLogout struct {
+    Name string
+}
+
+type LoginService struct {
+    *HandlerQueue
+    svc      ServiceContext
+    accounts *AccountStore
+    // Maximum number of clients logged in at once, unlimited if <= 0
+    maxClients int
+    // Names currently logged in
+    online map[string]bool
+    // If true, logging in with an unknown name creates an account for it
+    // using the passed authtoken as password.
+    AutoRegister bool
+    input        chan Msg
+}
+
+func NewLoginService(svc ServiceContext, accounts *AccountStore,
+maxClients int) *LoginService {
+    hq := NewHandlerQueue()
+    online := make(map[string]bool)
+    return &LoginService{hq, svc, accounts, maxClients, online, false, nil}
+}
+
+func (ls *LoginService) Chan() chan Msg { return ls.input }
+
+func (ls *LoginService) Run(input chan Msg) {
+    ls.input = input
+    Send(ls, ls.svc.Game, MsgTick{Origin: input}) // Service is ready
+
+    for {
+        msg := ls.GetMsg(input)
+        if m, ok := msg.(MsgQuit); ok {
+            AckQuit(ls, m)
+            return
+        }
+        ls.handle(msg)
+    }
+}
+
+func (ls *LoginService) handle(msg Msg) {
+    switch m := msg.(type) {
+    case MsgLogin:
+        reason := ls.login(m.Name, m.AuthToken)
+        ok := reason == protocol.LoginResult_ACCEPTED
+        Send(ls, m.Reply, MsgLoginResult{ok, reason})
+    case MsgLogout:
+        ls.online[m.Name] = false, false
+    }
+}
+
+// Checks the credentials and returns the reason the login should be refused,
+// or ACCEPTED if the client may log in.
+func (ls *LoginService) login(name, authtoken string) int32 {
+    acc := ls.accounts.Get(name)
+    if acc == nil {
+        if !ls.AutoRegister {
+            return protocol.LoginResult_ACCESS_DENIED
+        }
+        var err os.Error
+        if acc, err = ls.register(name, authtoken); err != nil {
+            log.Println("login: could not register", name+":", err)
+            return protocol.LoginResult_ACCESS_DENIED
+        }
+    }
+
+    switch {
+    case acc.Banned:
+        return protocol.LoginResult_BANNED
+    case !acc.CheckPassword(authtoken):
+        return protocol.LoginResult_ACCESS_DENIED
+    case ls.online[name]: // Only one client per account
+        return protocol.LoginResult_ACCESS_DENIED
+    case ls.maxClients > 0 && len(ls.online) >= ls.maxClients:
+        return protocol.LoginResult_SERVER_FULL
+    }
+    ls.online[name] = true
+    return protocol.LoginResult_ACCEPTED
+}
+
+// Creates and saves a new account
+func (ls *LoginService) register(name, password string) (*Account, os.Error) {
+    acc, err := ls.accounts.Add(name, password)
+    if err != nil {
+        return nil, err
+    }
+    if err = ls.accounts.Save(); err != nil {
+        return nil, err
+    }
+    log.Println("login: registered new account", name)
+    return acc, nil
+}
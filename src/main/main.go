@@ -6,31 +6,147 @@
 package main
 
 import (
+    "flag"
+    "log"
+    "os"
+    "os/signal"
     .   "core"
     "game"
     "comm"
+    "login"
     "pubsub"
     "sf"
+    "util"
+)
+
+const (
+    accountFile  = "accounts.txt"       // Where login accounts are stored
+    templateFile = "data/entities.json" // Where entity templates are stored
+    mapFile      = "data/forest.map"    // Terrain of the world
+    maxClients   = 32                   // Maximum number of clients at once
+)
+
+// Templates that Spider Forest spawns by name
+var requiredTemplates = []string{"Player", "Spider"}
+
+var (
+    seed          = flag.Int64("seed", 0, "seed for random numbers, random if 0")
+    deterministic = flag.Bool("deterministic", false,
+        "run the simulation deterministically, given the seed and client input")
+    record = flag.String("record", "",
+        "record client input to this file, implies -deterministic")
+    replay = flag.String("replay", "",
+        "replay the session recorded in this file instead of accepting clients")
+    snapshot = flag.String("snapshot", "",
+        "load the world from this file if it exists and save it there on exit")
+    hideUnseen = flag.Bool("hide-unseen", false,
+        "only send clients the entities their avatar can see")
+    continuous = flag.Bool("continuous", false,
+        "move entities continuously with collision radii instead of by cells")
+    bumpAttack = flag.Bool("bump-attack", true,
+        "attack entities by moving into them")
 )
 
 func main() {
+    flag.Parse()
     svc := NewServiceContext()
+    if *seed != 0 {
+        svc.Seed = *seed
+    }
+    svc.Deterministic = *deterministic || *record != "" || *replay != ""
+    if *snapshot != "" && (*record != "" || *replay != "") {
+        // Replays always start from the initial world
+        log.Fatal("-snapshot can't be combined with -record or -replay")
+    }
+
+    var rp *comm.Replay
+    var accounts *login.AccountStore
+    var err os.Error
+    if *replay != "" {
+        if rp, err = comm.LoadReplay(*replay); err != nil {
+            log.Fatal("Could not load replay: ", err)
+        }
+        svc.Seed = rp.Seed
+        // Passwords are not recorded, let everyone in
+        accounts = login.NewAccountStore()
+    } else if accounts, err = login.LoadAccountStore(accountFile); err != nil {
+        log.Fatal("Could not load accounts: ", err)
+    }
+    log.Println("Random seed:", svc.Seed)
+    loginSvc := login.NewLoginService(svc, accounts, maxClients)
+    loginSvc.AutoRegister = true // No other way to create accounts for now
+
+    commSvc := comm.NewCommService(svc, "0.0.0.0:9190")
+    if rp != nil {
+        commSvc.Replay(rp)
+    } else if *record != "" {
+        if err = commSvc.Record(*record); err != nil {
+            log.Fatal("Could not record: ", err)
+        }
+    }
 
     comm.AvatarFunc = sf.MakeAvatar
-    go comm.NewCommService(svc, "0.0.0.0:9190").Run(svc.Comm)
-    go pubsub.NewPubSub(svc).Run(svc.PubSub)
-    go sf.NewWorld(svc).Run(svc.World)
+    comm.HideUnseen = *hideUnseen
+    sf.RegisterStates()
+    sf.RegisterActions()
+    sf.RegisterEntities()
+    sf.DeclareReplication()
+    templates, err := LoadTemplates(templateFile)
+    if err != nil {
+        log.Fatal("Could not load entity templates: ", err)
+    }
+    for _, name := range requiredTemplates {
+        if _, ok := templates[name]; !ok {
+            log.Fatal("No entity template named ", name)
+        }
+    }
+    forest, err := sf.LoadMap(mapFile)
+    if err != nil {
+        log.Fatal("Could not load map: ", err)
+    }
+    terrain := forest.Message()
+    comm.Terrain = &terrain
+    world := sf.NewWorld(svc)
+    world.Map = forest
+    world.Continuous = *continuous
+    world.BumpAttack = *bumpAttack
+    policy := DefaultRestartPolicy
+    go SuperviseService("comm", commSvc, svc.Comm, policy)
+    go SuperviseService("pubsub", pubsub.NewPubSub(svc), svc.PubSub, policy)
+    go SuperviseService("world", world, svc.World, policy)
+    go SuperviseService("login", loginSvc, svc.Login, policy)
 
     game.InitFunc = initGameSvc
     game := game.NewGame(svc)
+    game.SnapshotFile = *snapshot
+    game.Templates = templates
+
+    go handleSignals(svc.Game)
+    game.Run(svc.Game) // Returns once everything has shut down
+    log.Println("Server stopped")
+    os.Exit(0)
+}
 
-    game.Run(svc.Game)
+// Asks the game to shut down on SIGINT or SIGTERM. A second signal exits
+// right away without waiting for the shutdown to finish.
+func handleSignals(game chan Msg) {
+    quitting := false
+    for sig := range signal.Incoming {
+        usig, ok := sig.(signal.UnixSignal)
+        if !ok || (usig != signal.SIGINT && usig != signal.SIGTERM) {
+            continue
+        }
+        if quitting {
+            log.Println("Received", sig, "again, exiting now")
+            os.Exit(1)
+        }
+        log.Println("Received", sig, "shutting down")
+        quitting = true
+        util.SendAsync(game, MsgQuit{}) // Game may be sleeping between ticks
+    }
 }
 
-// Initialize the game with some default data. Eventually this will come from
-// data files and those will be loaded elsewhere.
+// Initialize the game with some default data, used unless a snapshot is loaded.
 func initGameSvc(g *game.Game, svc ServiceContext) {
-    spider := sf.InitSpider(g.GetUid())
-    g.AddEntity(spider)
-    go spider.Run(svc)
+    g.SpawnTemplate("Spider", nil)
 }
@@ -53,10 +53,15 @@ func (ps *PubSub) Chan() chan Msg { return ps.input }
 // Starts a loop to receive and handle messages from the passed channel
 func (ps *PubSub) Run(input chan Msg) {
     ps.input = input
-    Send(ps, ps.svc.Game, MsgTick{input}) // Service is ready
+    Send(ps, ps.svc.Game, MsgTick{Origin: input}) // Service is ready
 
     for {
-        ps.handle(ps.GetMsg(input))
+        msg := ps.GetMsg(input)
+        if m, ok := msg.(MsgQuit); ok {
+            AckQuit(ps, m)
+            return
+        }
+        ps.handle(msg)
     }
 }
 
@@ -68,6 +73,8 @@ func (ps *PubSub) handle(msg Msg) {
         ps.subscribe(m)
     case UnsubscribeMsg:
         ps.unsubscribe(m)
+    case MsgTick: // Deterministic mode, everything before is published
+        Send(ps, m.Origin, MsgTick{Origin: ps.input})
     }
 }
 
@@ -78,22 +85,31 @@ func (ps *PubSub) publish(msg PublishMsg) {
     }
 }
 
-// Adds a subscription to the appropriate topic
+// Adds a subscription to the appropriate topic. Subscribing again, e.g. from
+// a restarted service, does nothing.
 func (ps *PubSub) subscribe(msg SubscribeMsg) {
     subscribers := ps.subscriptions[msg.Topic]
+    for _, s := range subscribers {
+        if msg.ReplyChan == s {
+            return
+        }
+    }
     ps.subscriptions[msg.Topic] = append(subscribers, msg.ReplyChan)
 }
 
 // Removes a subscription from the given topic
 func (ps *PubSub) unsubscribe(msg UnsubscribeMsg) {
     subs := ps.subscriptions[msg.Topic]
-    var rm_i int
+    rm_i := -1
     for i, s := range subs {
         if msg.ReplyChan == s {
             rm_i = i
-            break // TODO: Remove multiple or disallow multiple subscription?
+            break // subscribe never adds the same channel twice
         }
     }
+    if rm_i < 0 {
+        return // Not subscribed
+    }
 
     // Slice around rm_i
     subs = append(subs[:rm_i], subs[rm_i+1:]...)
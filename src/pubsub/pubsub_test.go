@@ -97,6 +97,22 @@ func TestUnsubscribe(t *testing.T) {
     quit <- true
 }
 
+// Test that subscribing the same channel twice only delivers once
+func TestDuplicateSubscribe(t *testing.T) {
+    ps := startPubSub()
+    ch := make(pubsub.ChanType)
+    ps <- pubsub.SubscribeMsg{topic, ch}
+    ps <- pubsub.SubscribeMsg{topic, ch}
+
+    go func() { ps <- pubsub.PublishMsg{topic, testData[0]} }()
+    <-ch
+    select {
+    case <-ch:
+        t.Fatalf("Message delivered twice to the same channel")
+    case <-time.After(1e8): // 100ms
+    }
+}
+
 // Makes 'count' channels and subscribes them
 func makeAndSubscribe(ps chan Msg, topic string, count int) (chans []pubsub.ChanType) {
     for i := 0; i < count; i++ {
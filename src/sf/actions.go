@@ -11,8 +11,20 @@ import (
     "pubsub"
 )
 
+// Registers the Spider Forest actions, so that entity templates can attach
+// them. Must be called before templates are loaded.
+func RegisterActions() {
+    RegisterAction(Move{})
+    RegisterAction(Attack{})
+    RegisterAction(SpiderAI{})
+    RegisterAction(AttackTarget{})
+}
+
 type Move struct {
     Direction *s3dm.V3
+    // If true, Direction is a velocity in units per second and the move covers
+    // the time of the entity's last tick. Otherwise Direction is moved as is.
+    Timed bool
 }
 
 func (a Move) Id() ActionId { return cmpId.Move }
@@ -20,13 +32,36 @@ func (a Move) Name() string { return "Move" }
 
 // Modifies the Position of an Entity with the passed Move vector.
 func (a Move) Act(ent Entity, svc ServiceContext) {
-    Send(ent, svc.World, MoveMsg{NewEntityDesc(ent), a.Direction})
+    vel := a.Direction
+    if a.Timed {
+        dt := ent.LastTick().Dt
+        vel = &s3dm.V3{vel.X * dt, vel.Y * dt, vel.Z * dt}
+    }
+    Send(ent, svc.World, MoveMsg{NewEntityDesc(ent), vel, strikeOf(ent),
+        ent.LastTick(), nil})
+}
+
+// Asks the world to let the calling entity attack the entity Target, which
+// happens if Target is within range and the entity has not attacked too
+// recently, see World.AttackDelay.
+type AttackTarget struct {
+    Target UniqueId
 }
 
-// Does damage to the calling entity, the entity being attacked.
-// Removes the entity if Health is zero.
+func (a AttackTarget) Id() ActionId { return cmpId.AttackTarget }
+func (a AttackTarget) Name() string { return "AttackTarget" }
+
+func (a AttackTarget) Act(ent Entity, svc ServiceContext) {
+    Send(ent, svc.World, AttackMsg{NewEntityDesc(ent), a.Target, strikeOf(ent),
+        ent.LastTick(), nil})
+}
+
+// Does damage to the calling entity, the entity being attacked. Whether the
+// Strike hits is rolled against the entity's Defence, the damage is reduced by
+// its Resistances. Removes the entity if Health is zero.
 type Attack struct {
     Attacker *EntityDesc
+    Strike   Strike
 }
 
 func (a Attack) Id() ActionId { return cmpId.Attack }
@@ -38,9 +73,16 @@ func (a Attack) Act(ent Entity, svc ServiceContext) {
     if health, ok = (ent.GetState(cmpId.Health)).(Health); !ok {
         return // Ent has not Health state
     }
-    health.Health-- // Extremely complex damage formula
+    var defence float32
+    if d, ok := ent.GetState(cmpId.Defence).(Defence); ok {
+        defence = d.Defence
+    }
+    outcome, damage := a.Strike.roll(ent.Rand(), defence)
+    damage = resist(ent, a.Strike.Damage.Type, damage)
+    health.Health -= damage
     ed := NewEntityDesc(ent)
-    Send(ent, svc.PubSub, pubsub.PublishMsg{"combat", MsgCombatHit{a.Attacker, ed, 1}})
+    hit := MsgCombatHit{a.Attacker, ed, damage, outcome}
+    Send(ent, svc.PubSub, pubsub.PublishMsg{"combat", hit})
     if health.Health <= 0 {
         ent.SetState(Remove{})
         Send(ent, svc.Game, MsgEntityRemoved{NewEntityDesc(ent)})
@@ -0,0 +1,145 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "math"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+    "sf/cmpId"
+)
+
+// Default World.AttackRange, diagonal neighbours are within it
+const attackRange = 1.5
+
+// Default World.AttackDelay
+const attackDelay = 0.5
+
+// Cells searched for a way to a hunted player, it is within Detection anyway
+const huntPathBudget = 200
+
+// Makes a spider hunt players. It wanders around while no player is within
+// Detection, chases the nearest one otherwise and attacks it once adjacent.
+// At low health it flees instead. Runs every tick, but only decides what to do
+// every Think seconds. How often it may attack is up to World.AttackDelay.
+type SpiderAI struct {
+    Detection float64 // Distance at which players are noticed
+    Speed     float64 // Cells per second
+    FleeBelow float64 // Fraction of MaxHealth below which the spider flees
+    Think     float64 // Seconds between decisions
+
+    // What the spider is up to, kept by adding the updated action again
+    dir    *s3dm.V3 // Direction of movement, nil when standing still
+    target *s3dm.V3 // Last known position of the hunted player, or nil
+    think  float64  // Seconds until the next decision
+}
+
+func (a SpiderAI) Id() ActionId { return cmpId.SpiderAI }
+func (a SpiderAI) Name() string { return "SpiderAI" }
+
+func (a SpiderAI) Act(ent Entity, svc ServiceContext) {
+    dt := ent.LastTick().Dt
+    a.think -= dt
+    if a.think <= 0 {
+        a.think = a.Think
+        a.decide(ent, svc)
+    }
+    pos, ok := ent.GetState(cmpId.Position).(Position)
+    if a.dir != nil && ok && !a.inRange(pos.Position) {
+        vel := &s3dm.V3{a.dir.X * a.Speed, a.dir.Y * a.Speed, 0}
+        Move{vel, true}.Act(ent, svc)
+    }
+    ent.AddAction(a)
+}
+
+// Picks what to do next: wander, hunt, attack or flee.
+func (a *SpiderAI) decide(ent Entity, svc ServiceContext) {
+    pos, ok := ent.GetState(cmpId.Position).(Position)
+    if !ok {
+        return // Nowhere in the world
+    }
+    a.target = nil
+
+    reply := make(chan Msg)
+    Send(ent, svc.World, MsgNearestEntity{ent.Uid(), cmpId.Player, a.Detection,
+        reply})
+    player, _ := Recv(ent, reply).(*EntityDesc)
+    if player != nil {
+        Send(ent, svc.World, GetPosMsg{player.Uid, reply})
+        a.target, _ = Recv(ent, reply).(*s3dm.V3)
+    }
+    if a.target != nil { // Players behind trees and walls go unnoticed
+        Send(ent, svc.World, MsgLineOfSight{pos.Position.X, pos.Position.Y,
+            a.target.X, a.target.Y, reply})
+        if !Recv(ent, reply).(bool) {
+            a.target = nil
+        }
+    }
+    if a.target == nil {
+        a.wander(ent)
+        return
+    }
+
+    toward := direction(pos.Position, a.target)
+    switch {
+    case a.fleeing(ent):
+        a.dir = &s3dm.V3{-toward.X, -toward.Y, 0}
+        a.target = nil
+    case a.inRange(pos.Position):
+        a.dir = nil
+        AttackTarget{player.Uid}.Act(ent, svc)
+    default:
+        a.dir = a.hunt(ent, svc, pos.Position, toward)
+    }
+}
+
+// Returns the direction towards the first step on the way to the target, or
+// straight at it if there is no way around whatever is in between.
+func (a *SpiderAI) hunt(ent Entity, svc ServiceContext, pos, toward *s3dm.V3) *s3dm.V3 {
+    reply := make(chan Msg)
+    Send(ent, svc.World, PathMsg{ent.Uid(), a.target, huntPathBudget, reply})
+    path := Recv(ent, reply).(PathReplyMsg)
+    if path.Result == PathNone || len(path.Cells) == 0 {
+        return toward
+    }
+    return direction(pos, path.Cells[0])
+}
+
+// Either stands still or walks off in a random direction at half speed.
+func (a *SpiderAI) wander(ent Entity) {
+    r := ent.Rand()
+    if r.Float64() < 0.5 {
+        a.dir = nil
+        return
+    }
+    angle := r.Float64() * 2 * math.Pi
+    a.dir = &s3dm.V3{0.5 * math.Cos(angle), 0.5 * math.Sin(angle), 0}
+}
+
+// Whether health is low enough to flee.
+func (a *SpiderAI) fleeing(ent Entity) bool {
+    health, ok := ent.GetState(cmpId.Health).(Health)
+    max, ok2 := ent.GetState(cmpId.MaxHealth).(MaxHealth)
+    if !ok || !ok2 || max.MaxHealth <= 0 {
+        return false
+    }
+    return float64(health.Health/max.MaxHealth) < a.FleeBelow
+}
+
+// Whether the hunted player is close enough to attack from pos.
+func (a *SpiderAI) inRange(pos *s3dm.V3) bool {
+    return a.target != nil && distSq(pos, a.target) <= attackRange*attackRange
+}
+
+// Returns the unit vector pointing from one position to another in the XY
+// plane, the zero vector if they are the same.
+func direction(from, to *s3dm.V3) *s3dm.V3 {
+    dx, dy := to.X-from.X, to.Y-from.Y
+    length := math.Sqrt(dx*dx + dy*dy)
+    if length == 0 {
+        return &s3dm.V3{0, 0, 0}
+    }
+    return &s3dm.V3{dx / length, dy / length, 0}
+}
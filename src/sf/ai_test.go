@@ -0,0 +1,168 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "fmt"
+    "math"
+    "testing"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+    "sf/cmpId"
+)
+
+// Uids of the spider and the player it may notice
+const (
+    spider = 1
+    player = 2
+)
+
+// A spider whose last tick is set by the test instead of Game
+type aiEntity struct {
+    *CmpData
+    tick MsgTick
+}
+
+func (e *aiEntity) LastTick() MsgTick { return e.tick }
+
+// Returns a spider at (1, 1) with health out of 4
+func newSpider(health float32) *aiEntity {
+    ent := &aiEntity{NewCmpData(spider, cmpId.Spider, "Spider"),
+        MsgTick{Tick: 1, Dt: 0.25}}
+    ent.SetState(Position{&s3dm.V3{1, 1, 0}})
+    ent.SetState(Health{health})
+    ent.SetState(MaxHealth{4})
+    return ent
+}
+
+// Puts the spider and the player, unless pos is nil, into a world with the
+// passed map and serves it on svc.World until told to quit. Returns the
+// player's channel, on which its attacks arrive.
+func startWorld(svc ServiceContext, rows []string, ent Entity,
+pos *s3dm.V3) chan Msg {
+    w := NewWorld(svc)
+    if rows != nil {
+        w.Map = testMap(rows...)
+    }
+    w.setPos(NewEntityDesc(ent), &s3dm.V3{1, 1, 0}, nil)
+    ch := make(chan Msg, 10)
+    if pos != nil {
+        w.setPos(&EntityDesc{ch, player, cmpId.Player, "Player"}, pos, nil)
+    }
+    go func() {
+        for {
+            msg := <-svc.World
+            if _, ok := msg.(MsgQuit); ok {
+                return
+            }
+            w.handle(msg)
+        }
+    }()
+    return ch
+}
+
+// Lets the spider decide once the world is done with what it was sent and
+// returns the number of attacks the player got.
+func decideOnce(a *SpiderAI, ent Entity, svc ServiceContext, ch chan Msg) int {
+    a.decide(ent, svc)
+    reply := make(chan Msg)
+    svc.World <- GetPosMsg{spider, reply} // Answered after everything else
+    <-reply
+    attacks := 0
+    for {
+        select {
+        case msg := <-ch:
+            if m, ok := msg.(MsgRunAction); ok && m.Action.Id() == cmpId.Attack {
+                attacks++
+            }
+        default:
+            return attacks
+        }
+    }
+    return 0 // Never reached
+}
+
+var spiderTests = []struct {
+    name    string
+    rows    []string
+    health  float32
+    player  *s3dm.V3 // Position of the player, nil if there is none
+    wander  bool     // Whether it should wander, dir is not checked then
+    dir     *s3dm.V3 // Expected direction, nil to stand still
+    target  bool     // Whether it should go after the player
+    attacks int
+}{
+    {"no player", nil, 4, nil, true, nil, false, 0},
+    {"out of sight", []string{
+        "......",
+        "...#..",
+        "......",
+    }, 4, &s3dm.V3{5, 1, 0}, true, nil, false, 0},
+    {"too far", nil, 4, &s3dm.V3{10, 1, 0}, true, nil, false, 0},
+    {"hunt", nil, 4, &s3dm.V3{5, 1, 0}, false, &s3dm.V3{1, 0, 0}, true, 0},
+    // Water can be seen across, the shortest way starts upwards
+    {"hunt around", []string{
+        "......",
+        "..~...",
+        "..~...",
+        "..~...",
+    }, 4, &s3dm.V3{5, 1, 0}, false, &s3dm.V3{0, -1, 0}, true, 0},
+    {"attack", nil, 4, &s3dm.V3{2, 2, 0}, false, nil, true, 1},
+    {"flee", nil, 1, &s3dm.V3{3, 1, 0}, false, &s3dm.V3{-1, 0, 0}, false, 0},
+    {"flee instead of attack", nil, 1, &s3dm.V3{1, 2, 0}, false,
+        &s3dm.V3{0, -1, 0}, false, 0},
+}
+
+func TestSpiderDecide(t *testing.T) {
+    for _, test := range spiderTests {
+        svc := NewServiceContext()
+        ent := newSpider(test.health)
+        ch := startWorld(svc, test.rows, ent, test.player)
+        a := &SpiderAI{Detection: 8, Speed: 2, FleeBelow: 0.3, Think: 0.25}
+        attacks := decideOnce(a, ent, svc, ch)
+        svc.World <- MsgQuit{}
+
+        switch {
+        case test.wander && a.dir != nil &&
+            math.Fabs(a.dir.Length()-0.5) > 1e-9:
+            t.Errorf("%s: wanders along %v, expected half speed", test.name,
+                a.dir)
+        case test.wander:
+        case test.dir == nil && a.dir != nil:
+            t.Errorf("%s: moves along %v, expected to stand still", test.name,
+                a.dir)
+        case test.dir != nil && (a.dir == nil || !near(a.dir, test.dir)):
+            t.Errorf("%s: moves along %v, expected %v", test.name, a.dir,
+                test.dir)
+        }
+        if (a.target != nil) != test.target {
+            t.Errorf("%s: target %v, expected one: %v", test.name, a.target,
+                test.target)
+        }
+        if attacks != test.attacks {
+            t.Errorf("%s: %d attacks, expected %d", test.name, attacks,
+                test.attacks)
+        }
+    }
+}
+
+// The spider tries to attack on every decision, World.AttackDelay alone
+// decides how often that works
+func TestSpiderAttackDelay(t *testing.T) {
+    svc := NewServiceContext()
+    ent := newSpider(4)
+    ch := startWorld(svc, nil, ent, &s3dm.V3{2, 1, 0})
+    defer func() { svc.World <- MsgQuit{} }()
+    a := &SpiderAI{Detection: 8, Speed: 2, FleeBelow: 0.3, Think: 0.25}
+    attacks := make([]int, 5)
+    for i := range attacks {
+        ent.tick = MsgTick{Tick: uint64(i + 1), Dt: 0.25}
+        attacks[i] = decideOnce(a, ent, svc, ch)
+    }
+    if fmt.Sprint(attacks) != "[1 0 1 0 1]" {
+        t.Errorf("Attacks %v, expected one every %g seconds", attacks,
+            attackDelay)
+    }
+}
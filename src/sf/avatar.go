@@ -6,12 +6,16 @@ package sf
 
 import (
     "log"
+    "math"
     "github.com/tm1rbrt/s3dm"
     .   "core"
     "game"
     "protocol"
 )
 
+// Cells per second a player moves at when asked to move at full length
+const playerSpeed = 4
+
 // An avatar is the agent of a client that acts on its behalf dealing with the
 // entity system. It is somewhat the opposite of observer (in the comm package),
 // as observer sends messages to the client, avatar receives messages from the
@@ -30,7 +34,7 @@ func MakeAvatar(svc ServiceContext, input chan *protocol.Message) (chan Msg,
 UniqueId) {
     ctrl := make(chan Msg)
     reply := make(chan Msg)
-    svc.Game <- game.MsgSpawnEntity{InitPlayer, reply}
+    svc.Game <- game.MsgSpawnTemplate{"Player", nil, reply}
     player := (<-reply).(*EntityDesc)
     a := avatar{svc, *player}
     go a.control(ctrl, input)
@@ -38,27 +42,83 @@ UniqueId) {
 }
 
 func (a *avatar) control(ctrl <-chan Msg, input <-chan *protocol.Message) {
+    // In deterministic mode input is held until the next tick
+    pending := make([]Msg, 0, 4)
     for {
         select {
         case msg := <-ctrl:
             switch m := msg.(type) {
-            // TODO: Handle MsgTick?
+            case MsgTick: // Only sent in deterministic mode
+                for _, p := range pending {
+                    a.player.Chan <- p
+                }
+                pending = pending[:0]
+                m.Origin <- MsgTick{}
             case MsgQuit:
                 a.player.Chan <- MsgSetState{Remove{true}}
                 a.svc.Game <- MsgEntityRemoved{&a.player}
                 return
             }
         case msg := <-input:
-            switch *msg.Type {
-            case protocol.Message_Type(protocol.Message_MOVE):
-                dir := msg.Move.Direction
-                vec := s3dm.NewV3(*dir.X, *dir.Y, *dir.Z)
-                a.player.Chan <- MsgRunAction{Move{vec}, false}
-            default:
-                log.Println("Client sent unhandled message, ignoring:",
-                    protocol.Message_Type_name[int32(*msg.Type)])
-
+            action := makeAction(msg)
+            if action == nil {
+                continue
             }
+            run := MsgRunAction{action, false}
+            if a.svc.Deterministic {
+                pending = append(pending, run)
+            } else {
+                a.player.Chan <- run
+            }
+        }
+    }
+}
+
+// Returns the action a client message asks for, or nil if there is none. Only
+// the parts of the message its type needs are looked at, but those are
+// optional, so messages lacking them are logged and ignored.
+func makeAction(msg *protocol.Message) Action {
+    switch *msg.Type {
+    case protocol.Message_Type(protocol.Message_MOVE):
+        if msg.Move == nil {
+            break
         }
+        dir := msg.Move.Direction
+        vel, ok := clampDirection(*dir.X, *dir.Y, *dir.Z)
+        if !ok {
+            log.Println("Client sent invalid move direction, ignoring")
+            return nil
+        }
+        // A velocity, so each move covers one tick at the current time scale
+        vel = &s3dm.V3{vel.X * playerSpeed, vel.Y * playerSpeed,
+            vel.Z * playerSpeed}
+        return Move{vel, true}
+    case protocol.Message_Type(protocol.Message_ATTACK):
+        if msg.Attack == nil {
+            break
+        }
+        return AttackTarget{UniqueId(*msg.Attack.Target)}
+    default:
+        log.Println("Client sent unhandled message, ignoring:",
+            protocol.Message_Type_name[int32(*msg.Type)])
+        return nil
+    }
+    log.Println("Client sent incomplete message, ignoring:",
+        protocol.Message_Type_name[int32(*msg.Type)])
+    return nil
+}
+
+// Returns the direction a client asked to move in, shortened to a length of at
+// most one. ok is false if any part of it is not a finite number.
+func clampDirection(x, y, z float64) (vel *s3dm.V3, ok bool) {
+    for _, f := range []float64{x, y, z} {
+        if math.IsNaN(f) || math.IsInf(f, 0) {
+            return nil, false
+        }
+    }
+    length := math.Sqrt(x*x + y*y + z*z)
+    if length > 1 {
+        x, y, z = x/length, y/length, z/length
     }
+    return s3dm.NewV3(x, y, z), true
 }
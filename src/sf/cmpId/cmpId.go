@@ -15,12 +15,19 @@ const (
     Asset
     Health
     MaxHealth
+    Collision
+    AttackSkill
+    Defence
+    Damage
+    Resistances
 )
 
 // Actions
 const (
     Move = iota + core.ACTION_END
     Attack
+    SpiderAI
+    AttackTarget
 )
 
 // Entities
@@ -0,0 +1,105 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "math"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+const (
+    // Radius of entities without a Collision state
+    defaultRadius = 0.4
+    // Largest radius looked for around a move, bigger entities may be missed
+    maxRadius = 2.
+    // Most steps a single move is checked in, longer moves take bigger steps
+    maxSteps = 64
+)
+
+// Returns the collision radius of an entity.
+func (w *World) radiusOf(uid UniqueId) float64 {
+    if r, ok := w.radius[uid]; ok {
+        return r
+    }
+    return defaultRadius
+}
+
+// Moves an entity from old_pos by vel in up to maxSteps small steps, stopping
+// at the last position where its circle neither runs into impassable terrain
+// nor comes closer to an entity it overlaps. Z is moved along, but only the XY
+// plane is checked.
+func (w *World) sweep(ent *EntityDesc, old_pos, vel *s3dm.V3) MoveResultMsg {
+    r := w.radiusOf(ent.Uid)
+    length := math.Sqrt(vel.X*vel.X + vel.Y*vel.Y + vel.Z*vel.Z)
+    step := math.Fmax(r/2, 0.05) // Small enough not to pass through anything
+    if math.IsNaN(length) || math.IsInf(length, 0) {
+        return MoveResultMsg{old_pos, nil, true}
+    }
+    steps := int(math.Fmin(math.Ceil(length/step), maxSteps))
+    if steps == 0 {
+        return MoveResultMsg{old_pos, nil, false}
+    }
+
+    // Everything that could be touched on the way
+    reach := r + maxRadius
+    others := w.index.candidates(
+        math.Fmin(old_pos.X, old_pos.X+vel.X)-reach,
+        math.Fmin(old_pos.Y, old_pos.Y+vel.Y)-reach,
+        math.Fmax(old_pos.X, old_pos.X+vel.X)+reach,
+        math.Fmax(old_pos.Y, old_pos.Y+vel.Y)+reach)
+
+    pos := old_pos
+    for i := 1; i <= steps; i++ {
+        f := float64(i) / float64(steps)
+        next := &s3dm.V3{old_pos.X + vel.X*f, old_pos.Y + vel.Y*f,
+            old_pos.Z + vel.Z*f}
+        if other := w.touching(ent.Uid, r, pos, next, others); other != nil {
+            return MoveResultMsg{pos, other, true}
+        }
+        if !w.Map.Passable(next) ||
+            (!w.circlePassable(next, r) && w.circlePassable(pos, r)) {
+            // Only the center has to stay clear while already touching
+            // terrain, so that entities can get away from it
+            return MoveResultMsg{pos, nil, true}
+        }
+        pos = next
+    }
+    return MoveResultMsg{pos, nil, false}
+}
+
+// Returns the first of others that a circle of radius r overlaps at next and
+// was not farther from at pos. Entities that already overlap can move apart.
+func (w *World) touching(uid UniqueId, r float64, pos, next *s3dm.V3,
+others []UniqueId) *EntityDesc {
+    for _, other := range others {
+        if other == uid {
+            continue
+        }
+        o := w.pos[other]
+        min := r + w.radiusOf(other)
+        d := distSq(next, o)
+        if d < min*min && d < distSq(pos, o) {
+            return w.descs[other]
+        }
+    }
+    return nil
+}
+
+// Whether a circle of radius r at pos is clear of impassable terrain. Checks
+// the center and eight points around the edge.
+func (w *World) circlePassable(pos *s3dm.V3, r float64) bool {
+    if !w.Map.Passable(pos) {
+        return false
+    }
+    for i := 0; i < 8; i++ {
+        angle := float64(i) * math.Pi / 4
+        edge := &s3dm.V3{pos.X + r*math.Cos(angle), pos.Y + r*math.Sin(angle), 0}
+        if !w.Map.Passable(edge) {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,98 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "math"
+    "strings"
+    "testing"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+// Uid of the entity being swept
+const mover = 1
+
+var sweepTests = []struct {
+    name    string
+    rows    []string
+    others  []*s3dm.V3 // Positions of entities in the way, uids from mover+1
+    from    *s3dm.V3
+    vel     *s3dm.V3
+    pos     *s3dm.V3 // Expected position after the move
+    contact UniqueId // Expected contact, 0 for none
+    blocked bool
+}{
+    {"open ground", nil, nil, &s3dm.V3{0.5, 0.5, 0}, &s3dm.V3{2, 0, 1},
+        &s3dm.V3{2.5, 0.5, 1}, 0, false},
+    {"no move", nil, nil, &s3dm.V3{0.5, 0.5, 0}, &s3dm.V3{0, 0, 0},
+        &s3dm.V3{0.5, 0.5, 0}, 0, false},
+    {"not a number", nil, nil, &s3dm.V3{0.5, 0.5, 0},
+        &s3dm.V3{math.NaN(), 0, 0}, &s3dm.V3{0.5, 0.5, 0}, 0, true},
+    // Steps of 0.2, the edge of the circle reaches the wall after 2.5
+    {"into wall", []string{"...#"}, nil, &s3dm.V3{0.5, 0.5, 0},
+        &s3dm.V3{3, 0, 0}, &s3dm.V3{2.5, 0.5, 0}, 0, true},
+    {"away from wall", []string{"...#"}, nil, &s3dm.V3{2.7, 0.5, 0},
+        &s3dm.V3{-1, 0, 0}, &s3dm.V3{1.7, 0.5, 0}, 0, false},
+    {"into circle", nil, []*s3dm.V3{&s3dm.V3{3.6, 0.5, 0}},
+        &s3dm.V3{0.5, 0.5, 0}, &s3dm.V3{3, 0, 0}, &s3dm.V3{2.7, 0.5, 0},
+        mover + 1, true},
+    {"past circle", nil, []*s3dm.V3{&s3dm.V3{2, 1.5, 0}},
+        &s3dm.V3{0.5, 0.5, 0}, &s3dm.V3{3, 0, 0}, &s3dm.V3{3.5, 0.5, 0},
+        0, false},
+    {"overlapping, apart", nil, []*s3dm.V3{&s3dm.V3{1, 0.5, 0}},
+        &s3dm.V3{0.5, 0.5, 0}, &s3dm.V3{-2, 0, 0}, &s3dm.V3{-1.5, 0.5, 0},
+        0, false},
+    {"overlapping, closer", nil, []*s3dm.V3{&s3dm.V3{1, 0.5, 0}},
+        &s3dm.V3{0.5, 0.5, 0}, &s3dm.V3{1, 0, 0}, &s3dm.V3{0.5, 0.5, 0},
+        mover + 1, true},
+    // Capped to maxSteps steps of 100/64, so it stops a whole step before
+    // the circle would reach the wall
+    {"max steps", []string{strings.Repeat(".", 60) + "#"}, nil,
+        &s3dm.V3{0.5, 0.5, 0}, &s3dm.V3{100, 0, 0},
+        &s3dm.V3{58.3125, 0.5, 0}, 0, true},
+}
+
+func TestSweep(t *testing.T) {
+    for _, test := range sweepTests {
+        w := NewWorld(NewServiceContext())
+        w.Continuous = true
+        if test.rows != nil {
+            w.Map = testMap(test.rows...)
+        }
+        ent := &EntityDesc{nil, mover, 0, "Mover"}
+        w.setPos(ent, test.from, nil)
+        for i, pos := range test.others {
+            uid := UniqueId(mover + 1 + i)
+            w.setPos(&EntityDesc{nil, uid, 0, "Other"}, pos, nil)
+        }
+
+        result := w.sweep(ent, test.from, test.vel)
+        if !near(result.Pos, test.pos) {
+            t.Errorf("%s: moved to %v, expected %v", test.name, result.Pos,
+                test.pos)
+        }
+        switch {
+        case test.contact == 0 && result.Contact != nil:
+            t.Errorf("%s: contact with %d", test.name, result.Contact.Uid)
+        case test.contact != 0 && result.Contact == nil:
+            t.Errorf("%s: no contact, expected %d", test.name, test.contact)
+        case test.contact != 0 && result.Contact.Uid != test.contact:
+            t.Errorf("%s: contact with %d, expected %d", test.name,
+                result.Contact.Uid, test.contact)
+        }
+        if result.Blocked != test.blocked {
+            t.Errorf("%s: blocked %v, expected %v", test.name, result.Blocked,
+                test.blocked)
+        }
+    }
+}
+
+// Whether a and b are the same position, give or take rounding errors
+func near(a, b *s3dm.V3) bool {
+    const epsilon = 1e-9
+    return math.Fabs(a.X-b.X) < epsilon && math.Fabs(a.Y-b.Y) < epsilon &&
+        math.Fabs(a.Z-b.Z) < epsilon
+}
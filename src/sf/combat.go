@@ -0,0 +1,88 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "rand"
+    .   "core"
+    "sf/cmpId"
+)
+
+// Damage types
+const (
+    Physical = "Physical"
+    Poison   = "Poison"
+)
+
+const (
+    baseHitChance  = 0.75 // Chance to hit when AttackSkill equals Defence
+    hitPerPoint    = 0.05 // Change of the chance to hit per point of difference
+    minHitChance   = 0.05
+    maxHitChance   = 0.95
+    critChance     = 0.05 // Chance that a hit is critical
+    critMultiplier = 2
+)
+
+// Entities without a Damage state hit like this
+var defaultDamage = Damage{1, 1, Physical}
+
+// The attacker's side of an attack, taken from its states when it attacks, so
+// that the victim can work out the outcome on its own.
+type Strike struct {
+    Attack float32
+    Damage Damage
+}
+
+// Returns the Strike of an entity attacking now.
+func strikeOf(ent Entity) Strike {
+    strike := Strike{0, defaultDamage}
+    if skill, ok := ent.GetState(cmpId.AttackSkill).(AttackSkill); ok {
+        strike.Attack = skill.Attack
+    }
+    if damage, ok := ent.GetState(cmpId.Damage).(Damage); ok {
+        strike.Damage = damage
+    }
+    return strike
+}
+
+// Rolls whether the strike hits an entity with the given defence and whether
+// it is critical, then how much damage it does before resistances.
+func (s Strike) roll(r *rand.Rand, defence float32) (HitOutcome, float32) {
+    chance := baseHitChance + float64(s.Attack-defence)*hitPerPoint
+    if chance < minHitChance {
+        chance = minHitChance
+    } else if chance > maxHitChance {
+        chance = maxHitChance
+    }
+    if r.Float64() >= chance {
+        return HitMissed, 0
+    }
+    damage := s.Damage.Min
+    if s.Damage.Max > s.Damage.Min {
+        damage += r.Float32() * (s.Damage.Max - s.Damage.Min)
+    }
+    if r.Float64() < critChance {
+        return HitCritical, damage * critMultiplier
+    }
+    return HitNormal, damage
+}
+
+// Returns damage of type typ after the resistances of ent. It is never
+// negative.
+func resist(ent Entity, typ string, damage float32) float32 {
+    list, ok := ent.GetState(cmpId.Resistances).(Resistances)
+    if !ok {
+        return damage
+    }
+    for _, res := range list.Resistances {
+        if res.Type == typ {
+            damage *= 1 - res.Fraction
+        }
+    }
+    if damage < 0 {
+        return 0
+    }
+    return damage
+}
@@ -0,0 +1,117 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "math"
+    "rand"
+    "testing"
+    .   "core"
+)
+
+// Number of rolls per test, enough to tell the chances apart
+const rolls = 50000
+
+var rollTests = []struct {
+    name    string
+    strike  Strike
+    defence float32
+    hit     float64 // Expected chance to hit
+}{
+    {"even", Strike{2, Damage{1, 3, Physical}}, 2, baseHitChance},
+    {"better attack", Strike{4, Damage{1, 3, Physical}}, 1,
+        baseHitChance + 3*hitPerPoint},
+    {"better defence", Strike{0, Damage{1, 3, Physical}}, 4,
+        baseHitChance - 4*hitPerPoint},
+    {"clamped high", Strike{100, Damage{1, 3, Physical}}, 0, maxHitChance},
+    {"clamped low", Strike{0, Damage{1, 3, Physical}}, 100, minHitChance},
+    {"fixed damage", Strike{0, Damage{2, 2, Poison}}, 0, baseHitChance},
+    {"max below min", Strike{0, Damage{2, 1, Poison}}, 0, baseHitChance},
+}
+
+func TestRoll(t *testing.T) {
+    for _, test := range rollTests {
+        r := rand.New(rand.NewSource(1))
+        min, max := test.strike.Damage.Min, test.strike.Damage.Max
+        if max < min {
+            max = min
+        }
+        hits, crits := 0, 0
+        for i := 0; i < rolls; i++ {
+            outcome, damage := test.strike.roll(r, test.defence)
+            switch outcome {
+            case HitMissed:
+                if damage != 0 {
+                    t.Fatalf("%s: miss did %g damage", test.name, damage)
+                }
+            case HitNormal:
+                hits++
+                if damage < min || damage > max {
+                    t.Fatalf("%s: hit did %g damage, expected %g-%g",
+                        test.name, damage, min, max)
+                }
+            case HitCritical:
+                hits++
+                crits++
+                if damage < min*critMultiplier || damage > max*critMultiplier {
+                    t.Fatalf("%s: critical hit did %g damage, expected %g-%g",
+                        test.name, damage, min*critMultiplier,
+                        max*critMultiplier)
+                }
+            }
+        }
+        if chance := float64(hits) / rolls; math.Fabs(chance-test.hit) > 0.02 {
+            t.Errorf("%s: hit %g of the time, expected %g", test.name, chance,
+                test.hit)
+        }
+        chance := float64(crits) / float64(hits)
+        if math.Fabs(chance-critChance) > 0.02 {
+            t.Errorf("%s: %g of hits critical, expected %g", test.name, chance,
+                critChance)
+        }
+    }
+}
+
+// Rolls only depend on the random numbers
+func TestRollRepeatable(t *testing.T) {
+    strike := Strike{1, Damage{0.5, 1.5, Poison}}
+    r1, r2 := rand.New(rand.NewSource(7)), rand.New(rand.NewSource(7))
+    for i := 0; i < 100; i++ {
+        o1, d1 := strike.roll(r1, 1)
+        o2, d2 := strike.roll(r2, 1)
+        if o1 != o2 || d1 != d2 {
+            t.Fatalf("Roll %d differs: %v %g and %v %g", i, o1, d1, o2, d2)
+        }
+    }
+}
+
+var resistTests = []struct {
+    name        string
+    resistances []Resistance // nil for no Resistances state
+    damage      float32
+    expected    float32
+}{
+    {"no state", nil, 2, 2},
+    {"other type", []Resistance{Resistance{Poison, 1}}, 2, 2},
+    {"immune", []Resistance{Resistance{Physical, 1}}, 2, 0},
+    {"half", []Resistance{Resistance{Physical, 0.5}}, 2, 1},
+    {"weakness", []Resistance{Resistance{Physical, -0.5}}, 2, 3},
+    {"over immune", []Resistance{Resistance{Physical, 1.5}}, 2, 0},
+    {"stacked", []Resistance{Resistance{Physical, 0.5}, Resistance{Poison, 1},
+        Resistance{Physical, 0.5}}, 4, 1},
+}
+
+func TestResist(t *testing.T) {
+    for _, test := range resistTests {
+        ent := NewCmpData(1, 0, "Test")
+        if test.resistances != nil {
+            ent.SetState(Resistances{test.resistances})
+        }
+        if damage := resist(ent, Physical, test.damage); damage != test.expected {
+            t.Errorf("%s: %g damage left, expected %g", test.name, damage,
+                test.expected)
+        }
+    }
+}
@@ -0,0 +1,178 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "container/heap"
+    "math"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+// Nodes searched when a PathMsg doesn't give a budget
+const defaultPathBudget = 1000
+
+// Outcome of a path search
+type PathResult int
+
+const (
+    PathFound   PathResult = iota // The path leads to the goal
+    PathPartial                   // The path leads as close to the goal as found
+    PathNone                      // No step can be taken towards the goal
+)
+
+// Requests a path for the entity Uid from its position to the cell of To,
+// around impassable terrain and cells occupied by other entities. The goal
+// cell itself may be occupied, e.g. by an entity to attack. At most Budget
+// cells are searched, defaultPathBudget if Budget <= 0.
+type PathMsg struct {
+    Uid    UniqueId
+    To     *s3dm.V3
+    Budget int
+    Reply  chan Msg // Reply type is PathReplyMsg
+}
+
+// Answer to a PathMsg. Cells are the cells to pass through, from the first
+// step to the last, given by their integer coordinates. They are empty for
+// PathNone.
+type PathReplyMsg struct {
+    Result PathResult
+    Cells  []*s3dm.V3
+}
+
+// A cell visited by the search
+type pathNode struct {
+    x, y  int
+    cost  float64 // Of the best path from the start found so far
+    guess float64 // cost plus estimated cost to the goal
+    prev  *pathNode
+    order int // Insertion order, breaks ties so searches are repeatable
+    index int // In the open heap, -1 once closed
+}
+
+// Open nodes, cheapest guess first
+type pathHeap []*pathNode
+
+func (h pathHeap) Len() int { return len(h) }
+func (h pathHeap) Less(i, j int) bool {
+    if h[i].guess != h[j].guess {
+        return h[i].guess < h[j].guess
+    }
+    return h[i].order < h[j].order
+}
+func (h pathHeap) Swap(i, j int) {
+    h[i], h[j] = h[j], h[i]
+    h[i].index = i
+    h[j].index = j
+}
+func (h *pathHeap) Push(x interface{}) {
+    n := x.(*pathNode)
+    n.index = len(*h)
+    *h = append(*h, n)
+}
+func (h *pathHeap) Pop() interface{} {
+    old := *h
+    n := old[len(old)-1]
+    *h = old[:len(old)-1]
+    n.index = -1
+    return n
+}
+
+// Estimated cost between two cells when moving in eight directions
+func octile(x1, y1, x2, y2 int) float64 {
+    dx := math.Fabs(float64(x2 - x1))
+    dy := math.Fabs(float64(y2 - y1))
+    return math.Fmax(dx, dy) + (math.Sqrt2-1)*math.Fmin(dx, dy)
+}
+
+// Searches a path with A* for a PathMsg.
+func (w *World) findPath(msg PathMsg) PathReplyMsg {
+    from, ok := w.pos[msg.Uid]
+    if !ok || msg.To == nil {
+        return PathReplyMsg{PathNone, nil}
+    }
+    budget := msg.Budget
+    if budget <= 0 {
+        budget = defaultPathBudget
+    }
+    sx, sy := cellOf(from)
+    gx, gy := cellOf(msg.To)
+    // Whether the cell may be entered on the way
+    free := func(x, y int) bool {
+        if x == gx && y == gy {
+            return true
+        }
+        if w.occupant(cellKey(x, y), msg.Uid) != nil {
+            return false
+        }
+        return w.Map.At(x, y).Passable()
+    }
+
+    start := &pathNode{sx, sy, 0, octile(sx, sy, gx, gy), nil, 0, 0}
+    nodes := map[int64]*pathNode{cellKey(sx, sy): start}
+    open := &pathHeap{}
+    heap.Push(open, start)
+    closest := start // Closest to the goal, for partial paths
+    for searched := 0; open.Len() > 0 && searched < budget; searched++ {
+        n := heap.Pop(open).(*pathNode)
+        if n.x == gx && n.y == gy {
+            return PathReplyMsg{PathFound, pathCells(n)}
+        }
+        if n.guess-n.cost < closest.guess-closest.cost {
+            closest = n
+        }
+        for dx := -1; dx <= 1; dx++ {
+            for dy := -1; dy <= 1; dy++ {
+                x, y := n.x+dx, n.y+dy
+                if (dx == 0 && dy == 0) || !free(x, y) {
+                    continue
+                }
+                step := 1.
+                if dx != 0 && dy != 0 {
+                    // No cutting corners past obstacles
+                    if !free(n.x+dx, n.y) || !free(n.x, n.y+dy) {
+                        continue
+                    }
+                    step = math.Sqrt2
+                }
+                cost := n.cost + step
+                key := cellKey(x, y)
+                next, seen := nodes[key]
+                if seen && (next.index < 0 || cost >= next.cost) {
+                    continue // Closed or no better
+                }
+                if !seen {
+                    next = &pathNode{x, y, 0, 0, nil, len(nodes), -1}
+                    nodes[key] = next
+                }
+                next.cost = cost
+                next.guess = cost + octile(x, y, gx, gy)
+                next.prev = n
+                if seen { // Cheaper now, move it up
+                    heap.Remove(open, next.index)
+                }
+                heap.Push(open, next)
+            }
+        }
+    }
+    if closest == start {
+        return PathReplyMsg{PathNone, nil}
+    }
+    return PathReplyMsg{PathPartial, pathCells(closest)}
+}
+
+// Returns the cells leading to n, without the start cell.
+func pathCells(n *pathNode) []*s3dm.V3 {
+    count := 0
+    for p := n; p.prev != nil; p = p.prev {
+        count++
+    }
+    cells := make([]*s3dm.V3, count)
+    for p := n; p.prev != nil; p = p.prev {
+        count--
+        cells[count] = &s3dm.V3{float64(p.x), float64(p.y), 0}
+    }
+    return cells
+}
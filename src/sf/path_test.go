@@ -0,0 +1,148 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+// Uid of the entity looking for a path
+const walker = 1
+
+var pathTests = []struct {
+    name   string
+    rows   []string
+    others []*s3dm.V3 // Positions of entities in the way
+    from   *s3dm.V3
+    to     *s3dm.V3
+    budget int
+    result PathResult
+    cells  string // Expected cells, not checked if empty
+    avoid  string // Cell the path must not pass through, if not empty
+}{
+    {"straight", nil, nil, &s3dm.V3{0, 0, 0}, &s3dm.V3{3, 0, 0}, 0,
+        PathFound, "(1,0) (2,0) (3,0)", ""},
+    {"negative", nil, nil, &s3dm.V3{-3, -3, 0}, &s3dm.V3{-1, -1, 0}, 0,
+        PathFound, "(-2,-2) (-1,-1)", ""},
+    {"same cell", nil, nil, &s3dm.V3{2.5, 2.5, 0}, &s3dm.V3{2, 2, 0}, 0,
+        PathFound, "", ""},
+    {"around wall", []string{
+        "#####",
+        "#.#.#",
+        "#.#.#",
+        "#...#",
+        "#####",
+    }, nil, &s3dm.V3{1, 1, 0}, &s3dm.V3{3, 1, 0}, 0,
+        PathFound, "(1,2) (1,3) (2,3) (3,3) (3,2) (3,1)", ""},
+    {"no corner cutting", []string{
+        ".#",
+        "..",
+    }, nil, &s3dm.V3{0, 0, 0}, &s3dm.V3{1, 1, 0}, 0,
+        PathFound, "(0,1) (1,1)", ""},
+    {"around entity", nil, []*s3dm.V3{&s3dm.V3{1, 0, 0}},
+        &s3dm.V3{0, 0, 0}, &s3dm.V3{2, 0, 0}, 0, PathFound, "", "(1,0)"},
+    {"occupied goal", nil, []*s3dm.V3{&s3dm.V3{1, 0, 0}},
+        &s3dm.V3{0, 0, 0}, &s3dm.V3{1, 0, 0}, 0, PathFound, "(1,0)", ""},
+    {"walled in", []string{
+        "###",
+        "#.#",
+        "###",
+    }, nil, &s3dm.V3{1, 1, 0}, &s3dm.V3{5, 5, 0}, 0, PathNone, "", ""},
+    {"goal walled in", []string{
+        "......",
+        "..###.",
+        "..#.#.",
+        "..###.",
+    }, nil, &s3dm.V3{0, 2, 0}, &s3dm.V3{3, 2, 0}, 100, PathPartial,
+        "(1,2)", ""},
+    {"over budget", nil, nil, &s3dm.V3{0, 0, 0}, &s3dm.V3{50, 0, 0}, 10,
+        PathPartial, "", ""},
+}
+
+func TestFindPath(t *testing.T) {
+    for _, test := range pathTests {
+        w := NewWorld(NewServiceContext())
+        if test.rows != nil {
+            w.Map = testMap(test.rows...)
+        }
+        w.setPos(&EntityDesc{nil, walker, 0, "Walker"}, test.from, nil)
+        for i, pos := range test.others {
+            uid := UniqueId(walker + 1 + i)
+            w.setPos(&EntityDesc{nil, uid, 0, "Other"}, pos, nil)
+        }
+
+        reply := w.findPath(PathMsg{walker, test.to, test.budget, nil})
+        cells := formatCells(reply.Cells)
+        if reply.Result != test.result {
+            t.Errorf("%s: result %d, expected %d (%s)", test.name,
+                reply.Result, test.result, cells)
+            continue
+        }
+        if test.cells != "" && cells != test.cells {
+            t.Errorf("%s: path %s, expected %s", test.name, cells, test.cells)
+        }
+        if test.avoid != "" && strings.Contains(cells, test.avoid) {
+            t.Errorf("%s: path %s passes through %s", test.name, cells,
+                test.avoid)
+        }
+        if test.result == PathNone && len(reply.Cells) > 0 {
+            t.Errorf("%s: cells %s given without a path", test.name, cells)
+        }
+        if test.result == PathPartial && len(reply.Cells) == 0 {
+            t.Errorf("%s: partial path is empty", test.name)
+        }
+        if test.budget > 0 && len(reply.Cells) > test.budget {
+            t.Errorf("%s: path %s longer than the budget", test.name, cells)
+        }
+        if test.result != PathNone {
+            checkSteps(t, test.name, w, test.from, reply.Cells)
+        }
+    }
+}
+
+// Checks that each cell of a path is next to the one before it and free
+func checkSteps(t *testing.T, name string, w *World, from *s3dm.V3,
+cells []*s3dm.V3) {
+    x, y := cellOf(from)
+    for _, cell := range cells {
+        cx, cy := cellOf(cell)
+        if cx-x < -1 || cx-x > 1 || cy-y < -1 || cy-y > 1 {
+            t.Errorf("%s: step from (%d,%d) to (%d,%d)", name, x, y, cx, cy)
+        }
+        if !w.Map.At(cx, cy).Passable() {
+            t.Errorf("%s: path passes through impassable (%d,%d)", name, cx, cy)
+        }
+        x, y = cx, cy
+    }
+}
+
+// Formats cells as "(x,y) (x,y) ..."
+func formatCells(cells []*s3dm.V3) string {
+    list := make([]string, len(cells))
+    for i, cell := range cells {
+        x, y := cellOf(cell)
+        list[i] = fmt.Sprintf("(%d,%d)", x, y)
+    }
+    return strings.Join(list, " ")
+}
+
+// Builds a map from rows of map file symbols, see LoadMap.
+func testMap(rows ...string) *Map {
+    m := &Map{len(rows[0]), len(rows), make([]Terrain, len(rows[0])*len(rows))}
+    for y, row := range rows {
+        for x := 0; x < len(row); x++ {
+            for t, info := range terrainTypes {
+                if info.symbol == row[x] {
+                    m.cells[y*m.Width+x] = Terrain(t)
+                }
+            }
+        }
+    }
+    return m
+}
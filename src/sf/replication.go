@@ -0,0 +1,20 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "comm"
+    "sf/cmpId"
+)
+
+// Declares which Spider Forest states are sent to clients. Must be called
+// before the comm service is started.
+func DeclareReplication() {
+    comm.ReplicateState(cmpId.Position, comm.Everyone)
+    comm.ReplicateState(cmpId.Asset, comm.Everyone)
+    // Players only get to know their own health
+    comm.ReplicateState(cmpId.Health, comm.OwnerOnly)
+    comm.ReplicateState(cmpId.MaxHealth, comm.OwnerOnly)
+}
@@ -0,0 +1,92 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "math"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+// Nothing further away than this can be seen, it bounds the cost of field of
+// view queries
+const maxSightRadius = 32
+
+// Whether (x1, y1) can be seen from (x0, y0). Walks the cells of the line
+// between them with Bresenham's algorithm, the line is blocked if any cell in
+// between is opaque. The end cells themselves never block, a wall can be seen.
+func (w *World) lineOfSight(x0, y0, x1, y1 int) bool {
+    dx, dy := x1-x0, y1-y0
+    sx, sy := 1, 1
+    if dx < 0 {
+        dx, sx = -dx, -1
+    }
+    if dy < 0 {
+        dy, sy = -dy, -1
+    }
+    err := dx - dy
+    x, y := x0, y0
+    for {
+        if x == x1 && y == y1 {
+            return true
+        }
+        if (x != x0 || y != y0) && w.Map.At(x, y).Opaque() {
+            return false
+        }
+        e2 := 2 * err
+        if e2 > -dy {
+            err -= dy
+            x += sx
+        }
+        if e2 < dx {
+            err += dx
+            y += sy
+        }
+    }
+    return true // Never gets here
+}
+
+// Whether the cell of to can be seen from the cell of from.
+func (w *World) canSee(from, to *s3dm.V3) bool {
+    x0, y0 := cellOf(from)
+    x1, y1 := cellOf(to)
+    return w.lineOfSight(x0, y0, x1, y1)
+}
+
+// Returns the cells within radius of (x, y) that can be seen from it, sorted
+// by Y and then by X. The radius is capped at maxSightRadius.
+func (w *World) fieldOfView(x, y int, radius float64) []Cell {
+    radius = math.Fmin(radius, maxSightRadius)
+    r := int(radius)
+    cells := make([]Cell, 0, 8)
+    for cy := y - r; cy <= y+r; cy++ {
+        for cx := x - r; cx <= x+r; cx++ {
+            dx, dy := float64(cx-x), float64(cy-y)
+            if dx*dx+dy*dy > radius*radius {
+                continue
+            }
+            if w.lineOfSight(x, y, cx, cy) {
+                cells = append(cells, Cell{cx, cy})
+            }
+        }
+    }
+    return cells
+}
+
+// Returns the entities within radius of the entity uid that it can see, sorted
+// by uid. The list is empty if uid has no position.
+func (w *World) visibleEntities(uid UniqueId, radius float64) []*EntityDesc {
+    center, ok := w.pos[uid]
+    if !ok {
+        return nil
+    }
+    list := make([]*EntityDesc, 0, 8)
+    for _, desc := range w.entitiesInRadius(uid, radius) {
+        if w.canSee(center, w.pos[desc.Uid]) {
+            list = append(list, desc)
+        }
+    }
+    return list
+}
@@ -0,0 +1,80 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "testing"
+    .   "core"
+)
+
+var sightMap = []string{
+    ".......",
+    "...#...",
+    "...~...",
+    "...T...",
+    ".......",
+}
+
+var sightTests = []struct {
+    name           string
+    x0, y0, x1, y1 int
+    visible        bool
+}{
+    {"open", 0, 0, 6, 0, true},
+    {"same cell", 2, 2, 2, 2, true},
+    {"neighbour", 2, 1, 3, 1, true},
+    {"behind wall", 0, 1, 6, 1, false},
+    {"behind wall reversed", 6, 1, 0, 1, false},
+    {"behind tree", 0, 3, 6, 3, false},
+    {"across water", 0, 2, 6, 2, true},
+    {"diagonal past wall", 2, 0, 4, 2, false},
+    {"wall itself", 0, 1, 3, 1, true},
+    {"from inside wall", 3, 1, 6, 1, true},
+    {"outside map", -5, -5, 10, -5, true},
+}
+
+// Opaque cells in between block the line, the end cells never do
+func TestLineOfSight(t *testing.T) {
+    w := NewWorld(NewServiceContext())
+    w.Map = testMap(sightMap...)
+    for _, test := range sightTests {
+        if w.lineOfSight(test.x0, test.y0, test.x1, test.y1) != test.visible {
+            t.Errorf("%s: (%d,%d) to (%d,%d) visible is not %v", test.name,
+                test.x0, test.y0, test.x1, test.y1, test.visible)
+        }
+    }
+}
+
+func TestFieldOfView(t *testing.T) {
+    w := NewWorld(NewServiceContext())
+    w.Map = testMap(sightMap...)
+    seen := make(map[int64]bool)
+    for _, cell := range w.fieldOfView(0, 1, 6) {
+        seen[cellKey(cell.X, cell.Y)] = true
+    }
+    for _, test := range []struct {
+        cell    Cell
+        visible bool
+    }{
+        {Cell{0, 1}, true},  // Own cell
+        {Cell{3, 1}, true},  // Wall in the way
+        {Cell{4, 1}, false}, // Behind it
+        {Cell{5, 2}, true},  // Across water
+        {Cell{6, 1}, false}, // Behind the wall at the edge of the range
+        {Cell{0, 7}, true},  // Edge of the range
+        {Cell{5, 5}, false}, // Beyond the edge
+    } {
+        if seen[cellKey(test.cell.X, test.cell.Y)] != test.visible {
+            t.Errorf("Cell %v visible is not %v", test.cell, test.visible)
+        }
+    }
+
+    // The radius is capped
+    for _, cell := range w.fieldOfView(0, 0, 1e9) {
+        if cell.X > maxSightRadius || cell.Y > maxSightRadius {
+            t.Fatalf("Cell %v beyond maxSightRadius", cell)
+        }
+    }
+}
@@ -0,0 +1,124 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "math"
+    "sort"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+// Translates a 3D vector into cell coordinates. X and Y values are rounded
+// down, so that cells left of and below the origin are as wide as the others.
+func cellOf(vec *s3dm.V3) (x, y int) {
+    return clampCell(vec.X), clampCell(vec.Y)
+}
+
+// Packs cell or bucket coordinates into a single map key.
+func cellKey(x, y int) int64 {
+    return int64(x)<<32 | int64(uint32(y))
+}
+
+// Returns the map key of the cell a vector is in.
+func keyOf(vec *s3dm.V3) int64 {
+    return cellKey(cellOf(vec))
+}
+
+// Rounds a coordinate down to a cell coordinate, clamped to what cell keys hold.
+func clampCell(f float64) int {
+    f = math.Floor(f)
+    if f > math.MaxInt32 {
+        return math.MaxInt32
+    } else if f < math.MinInt32 {
+        return math.MinInt32
+    }
+    return int(f)
+}
+
+// Buckets of the spatial index are 2^bucketShift cells on a side
+const bucketShift = 4
+
+// Uniform grid of buckets holding the entities whose cell is in them, so that
+// area queries only have to look at the buckets that overlap the area.
+type spatialIndex struct {
+    buckets map[int64]map[UniqueId]bool
+}
+
+func newSpatialIndex() *spatialIndex {
+    return &spatialIndex{make(map[int64]map[UniqueId]bool)}
+}
+
+// Returns the key of the bucket a cell is in. Shifting rounds down, so
+// negative cells end up in the right bucket as well.
+func bucketOf(x, y int) int64 {
+    return cellKey(x>>bucketShift, y>>bucketShift)
+}
+
+func (si *spatialIndex) insert(uid UniqueId, pos *s3dm.V3) {
+    key := bucketOf(cellOf(pos))
+    bucket, ok := si.buckets[key]
+    if !ok {
+        bucket = make(map[UniqueId]bool)
+        si.buckets[key] = bucket
+    }
+    bucket[uid] = true
+}
+
+func (si *spatialIndex) remove(uid UniqueId, pos *s3dm.V3) {
+    key := bucketOf(cellOf(pos))
+    bucket, ok := si.buckets[key]
+    if !ok {
+        return
+    }
+    bucket[uid] = false, false
+    if len(bucket) == 0 {
+        si.buckets[key] = nil, false
+    }
+}
+
+func (si *spatialIndex) move(uid UniqueId, old_pos, new_pos *s3dm.V3) {
+    if bucketOf(cellOf(old_pos)) == bucketOf(cellOf(new_pos)) {
+        return // Same bucket, nothing to do
+    }
+    si.remove(uid, old_pos)
+    si.insert(uid, new_pos)
+}
+
+// Returns the entities in buckets that overlap the rectangle from (minX, minY)
+// to (maxX, maxY), sorted by uid. They still have to be checked against the
+// exact area.
+func (si *spatialIndex) candidates(minX, minY, maxX, maxY float64) []UniqueId {
+    min_bx, min_by := clampCell(minX)>>bucketShift, clampCell(minY)>>bucketShift
+    max_bx, max_by := clampCell(maxX)>>bucketShift, clampCell(maxY)>>bucketShift
+    list := make([]int, 0, 8)
+    area := float64(max_bx-min_bx+1) * float64(max_by-min_by+1)
+    if area > float64(len(si.buckets)) {
+        // Large area, cheaper to look at the buckets that exist
+        for key, bucket := range si.buckets {
+            bx, by := int(int32(key>>32)), int(int32(key))
+            if bx < min_bx || bx > max_bx || by < min_by || by > max_by {
+                continue
+            }
+            for uid := range bucket {
+                list = append(list, int(uid))
+            }
+        }
+    } else {
+        for bx := min_bx; bx <= max_bx; bx++ {
+            for by := min_by; by <= max_by; by++ {
+                for uid := range si.buckets[cellKey(bx, by)] {
+                    list = append(list, int(uid))
+                }
+            }
+        }
+    }
+    sort.SortInts(list) // Map order is random, answers should not be
+    uids := make([]UniqueId, len(list))
+    for i, uid := range list {
+        uids[i] = UniqueId(uid)
+    }
+    return uids
+}
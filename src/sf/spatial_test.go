@@ -0,0 +1,118 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "fmt"
+    "math"
+    "testing"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+var cellTests = []struct {
+    pos  *s3dm.V3
+    x, y int
+}{
+    {&s3dm.V3{0, 0, 0}, 0, 0},
+    {&s3dm.V3{0.5, 1.9, 0}, 0, 1},
+    {&s3dm.V3{-0.5, -0.1, 0}, -1, -1},
+    {&s3dm.V3{-1, -1.5, 0}, -1, -2},
+    {&s3dm.V3{-1e12, 1e12, 0}, math.MinInt32, math.MaxInt32},
+}
+
+// Cells round down on both sides of the origin, terrain agrees with them
+func TestCellOf(t *testing.T) {
+    m := testMap(
+        "#.",
+        "..",
+    )
+    for _, test := range cellTests {
+        if x, y := cellOf(test.pos); x != test.x || y != test.y {
+            t.Errorf("%v in cell (%d, %d), expected (%d, %d)", test.pos, x, y,
+                test.x, test.y)
+        }
+        wall := test.x == 0 && test.y == 0
+        if passable := m.Passable(test.pos); passable == wall {
+            t.Errorf("%v passable: %v, expected %v", test.pos, passable, !wall)
+        }
+    }
+}
+
+var bucketTests = []struct {
+    x, y   int
+    bx, by int
+}{
+    {0, 0, 0, 0},
+    {15, 15, 0, 0},
+    {16, 0, 1, 0},
+    {-1, -1, -1, -1},
+    {-16, 0, -1, 0},
+    {-17, 3, -2, 0},
+    {math.MinInt32, math.MaxInt32, math.MinInt32 >> bucketShift,
+        math.MaxInt32 >> bucketShift},
+}
+
+// Negative cells round down to their bucket instead of towards zero
+func TestBucketOf(t *testing.T) {
+    for _, test := range bucketTests {
+        if key := bucketOf(test.x, test.y); key != cellKey(test.bx, test.by) {
+            t.Errorf("Cell (%d, %d) in bucket %x, expected (%d, %d)", test.x,
+                test.y, key, test.bx, test.by)
+        }
+    }
+}
+
+// Entities placed by the spatial index tests, by uid
+var indexed = map[UniqueId]*s3dm.V3{
+    1: &s3dm.V3{-1, -1, 0},
+    2: &s3dm.V3{-17, 3, 0},
+    3: &s3dm.V3{15, 15, 0},
+    4: &s3dm.V3{16, 16, 0},
+    5: &s3dm.V3{1000, -1000, 0},
+}
+
+var candidateTests = []struct {
+    minX, minY, maxX, maxY float64
+    uids                   string
+}{
+    {-1, -1, -1, -1, "[1]"},
+    {0, 0, 15, 15, "[3]"},
+    {-20, -20, 20, 20, "[1 2 3 4]"},
+    {-16, -16, -1, -1, "[1]"},
+    {2000, 2000, 3000, 3000, "[]"},
+    // Large areas, looked up by the buckets that exist
+    {-1e12, -1e12, 1e12, 1e12, "[1 2 3 4 5]"},
+    {math.Inf(-1), math.Inf(-1), math.Inf(1), math.Inf(1), "[1 2 3 4 5]"},
+    {0, math.Inf(-1), math.Inf(1), -1, "[5]"},
+}
+
+func TestCandidates(t *testing.T) {
+    si := newSpatialIndex()
+    for uid, pos := range indexed {
+        si.insert(uid, pos)
+    }
+    for _, test := range candidateTests {
+        uids := si.candidates(test.minX, test.minY, test.maxX, test.maxY)
+        if s := fmt.Sprint(uids); s != test.uids {
+            t.Errorf("Candidates in (%g, %g)-(%g, %g) are %s, expected %s",
+                test.minX, test.minY, test.maxX, test.maxY, s, test.uids)
+        }
+    }
+
+    // Moving to another bucket and removing are reflected too
+    si.move(3, indexed[3], &s3dm.V3{-5, -5, 0})
+    if s := fmt.Sprint(si.candidates(0, 0, 15, 15)); s != "[]" {
+        t.Errorf("Moved entity still in old bucket: %s", s)
+    }
+    if s := fmt.Sprint(si.candidates(-16, -16, -1, -1)); s != "[1 3]" {
+        t.Errorf("Moved entity not in new bucket: %s", s)
+    }
+    buckets := len(si.buckets)
+    si.remove(5, indexed[5])
+    if len(si.buckets) != buckets-1 {
+        t.Errorf("Empty bucket not dropped")
+    }
+}
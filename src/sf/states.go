@@ -2,6 +2,7 @@
 // Use of this source code is governed by the GNU General Public License
 // version 3 (or any later version). See the file COPYING for details.
 
+// Spider Forest package. Contains all code specific to the Spider Forest gameplay.
 package sf
 
 import (
@@ -10,6 +11,27 @@ import (
     "github.com/tm1rbrt/s3dm"
 )
 
+// Registers the Spider Forest states, so they can be decoded and stored. Must
+// be called before any services are started.
+func RegisterStates() {
+    RegisterState(Position{})
+    RegisterState(Asset{})
+    RegisterState(Health{})
+    RegisterState(MaxHealth{})
+    RegisterState(Collision{})
+    RegisterState(AttackSkill{})
+    RegisterState(Defence{})
+    RegisterState(Damage{})
+    RegisterState(Resistances{})
+}
+
+// Registers the Spider Forest entity types, so that templates can refer to
+// them. Must be called before templates are loaded.
+func RegisterEntities() {
+    RegisterEntity("Player", cmpId.Player)
+    RegisterEntity("Spider", cmpId.Spider)
+}
+
 type Position struct {
     Position *s3dm.V3
 }
@@ -38,3 +60,53 @@ type MaxHealth struct {
 
 func (x MaxHealth) Id() StateId  { return cmpId.MaxHealth }
 func (x MaxHealth) Name() string { return "MaxHealth" }
+
+// Radius of the circle an entity takes up in the XY plane, used when the world
+// moves entities continuously.
+type Collision struct {
+    Radius float64
+}
+
+func (x Collision) Id() StateId  { return cmpId.Collision }
+func (x Collision) Name() string { return "Collision" }
+
+// How good an entity is at hitting, weighed against the Defence of its victim.
+type AttackSkill struct {
+    Attack float32
+}
+
+func (x AttackSkill) Id() StateId  { return cmpId.AttackSkill }
+func (x AttackSkill) Name() string { return "AttackSkill" }
+
+// How good an entity is at not getting hit.
+type Defence struct {
+    Defence float32
+}
+
+func (x Defence) Id() StateId  { return cmpId.Defence }
+func (x Defence) Name() string { return "Defence" }
+
+// Damage an entity does with a hit, a random amount from Min to Max of damage
+// type Type, e.g. Physical.
+type Damage struct {
+    Min, Max float32
+    Type     string
+}
+
+func (x Damage) Id() StateId  { return cmpId.Damage }
+func (x Damage) Name() string { return "Damage" }
+
+// Fraction of damage of a type that an entity shrugs off. 1 makes it immune, a
+// negative fraction makes it take extra damage.
+type Resistance struct {
+    Type     string
+    Fraction float32
+}
+
+// Resistances of an entity, damage types not listed are not resisted.
+type Resistances struct {
+    Resistances []Resistance
+}
+
+func (x Resistances) Id() StateId  { return cmpId.Resistances }
+func (x Resistances) Name() string { return "Resistances" }
@@ -0,0 +1,135 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "strings"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+// Static type of a cell in the world
+type Terrain byte
+
+const (
+    Ground Terrain = iota
+    Wall
+    Tree
+    Water
+
+    TERRAIN_END // END must always be last
+)
+
+// Properties of each terrain type, indexed by Terrain
+var terrainTypes = [TERRAIN_END]struct {
+    name     string
+    symbol   byte // Character used in map files
+    passable bool
+    opaque   bool // Blocks sight
+}{
+    {"Ground", '.', true, false},
+    {"Wall", '#', false, true},
+    {"Tree", 'T', false, true},
+    {"Water", '~', false, false},
+}
+
+func (t Terrain) Name() string   { return terrainTypes[t].name }
+func (t Terrain) Passable() bool { return terrainTypes[t].passable }
+func (t Terrain) Opaque() bool   { return terrainTypes[t].opaque }
+
+// The static terrain of a rectangular area of the world, starting at cell
+// (0, 0). Everything outside of it is open ground.
+type Map struct {
+    Width, Height int
+    cells         []Terrain // Row by row
+}
+
+// Returns a map without any terrain, the world is all open ground.
+func NewMap() *Map {
+    return &Map{0, 0, nil}
+}
+
+// Reads a map from a text file. Each line is a row of cells, each character a
+// cell: '.' (or a space) is ground, '#' a wall, 'T' a tree and '~' water. The
+// first line is the row at Y = 0, the first character the cell at X = 0.
+// Short lines are filled up with ground.
+func LoadMap(filename string) (*Map, os.Error) {
+    file, err := os.Open(filename, os.O_RDONLY, 0)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    symbols := make(map[byte]Terrain)
+    for t, info := range terrainTypes {
+        symbols[info.symbol] = Terrain(t)
+    }
+    symbols[' '] = Ground
+
+    r := bufio.NewReader(file)
+    rows := [][]Terrain{}
+    width := 0
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil && err != os.EOF {
+            return nil, err
+        }
+        if line == "" && err == os.EOF {
+            break
+        }
+        line = strings.TrimRight(line, "\r\n")
+        row := make([]Terrain, len(line))
+        for x := 0; x < len(line); x++ {
+            t, ok := symbols[line[x]]
+            if !ok {
+                return nil, os.NewError(fmt.Sprintf("%s:%d: unknown terrain %q",
+                    filename, len(rows)+1, line[x]))
+            }
+            row[x] = t
+        }
+        rows = append(rows, row)
+        if len(row) > width {
+            width = len(row)
+        }
+        if err == os.EOF {
+            break
+        }
+    }
+
+    m := &Map{width, len(rows), make([]Terrain, width*len(rows))}
+    for y, row := range rows {
+        copy(m.cells[y*width:], row) // The rest stays Ground
+    }
+    return m, nil
+}
+
+// Returns the terrain of the cell (x, y).
+func (m *Map) At(x, y int) Terrain {
+    if x < 0 || y < 0 || x >= m.Width || y >= m.Height {
+        return Ground
+    }
+    return m.cells[y*m.Width+x]
+}
+
+// Whether entities may enter the cell that pos is in, see cellOf.
+func (m *Map) Passable(pos *s3dm.V3) bool {
+    return m.At(cellOf(pos)).Passable()
+}
+
+// Returns the terrain as a message for clients.
+func (m *Map) Message() MsgTerrain {
+    cells := make([]byte, len(m.cells))
+    for i, t := range m.cells {
+        cells[i] = byte(t)
+    }
+    types := make([]string, TERRAIN_END)
+    for t, info := range terrainTypes {
+        types[t] = info.name
+    }
+    return MsgTerrain{0, 0, m.Width, m.Height, cells, types}
+}
@@ -5,7 +5,6 @@
 package sf
 
 import (
-    "fmt"
     "log"
     "math"
     "rand"
@@ -18,71 +17,246 @@ import (
 
 // Signal entity's intent to move from point A to point B
 type MoveMsg struct {
-    Ent *EntityDesc // The moving entity
-    Vel *s3dm.V3    // The entity's velocity vector
+    Ent    *EntityDesc // The moving entity
+    Vel    *s3dm.V3    // The entity's velocity vector
+    Strike Strike      // Used if the move runs into another entity
+    Tick   MsgTick     // Last tick of the entity, for the attack cooldown
+    Reply  chan Msg    // If not nil, the MoveResultMsg is sent back on it
 }
 
-// Translates a 3D vector into a cell position. X and Y values are truncated.
-func hashV3(vec *s3dm.V3) string {
-    return fmt.Sprintf("%d+%d", int(vec.X), int(vec.Y))
+// Requests that Attacker attack the entity Target. The attack only happens if
+// both are in the world, they differ, Target is within AttackRange and
+// Attacker is done waiting AttackDelay since its last attack.
+type AttackMsg struct {
+    Attacker *EntityDesc
+    Target   UniqueId
+    Strike   Strike
+    Tick     MsgTick  // Last tick of the attacker
+    Reply    chan Msg // If not nil, whether the attack happened is sent back
+}
+
+// Outcome of a MoveMsg
+type MoveResultMsg struct {
+    Pos     *s3dm.V3    // Position of the entity after the move, nil if it has none
+    Contact *EntityDesc // Entity that was run into, if any
+    Blocked bool        // True if the entity did not get all the way
+}
+
+// Requests the position of the entity identified by Uid. The reply is a copy
+// of it, nil if the entity has no position.
+type GetPosMsg struct {
+    Uid   UniqueId
+    Reply chan Msg // Reply type is *s3dm.V3
 }
 
 // Service that controls spatial relations between entities. The world is divided
-// into a grid, each of part of the grid is a cell. Currently, only one entity may
-// occupy a cell at any given time.
+// into a grid, each of part of the grid is a cell. Unless entities move
+// continuously, only one entity may occupy a cell at any given time, and none
+// may enter cells whose terrain is not passable.
 type World struct {
     *HandlerQueue
     svc ServiceContext
-    // Entities may be looked up by position with this
-    ents map[string]chan Msg
+    // Entities may be looked up by cell with this, see keyOf. Small entities
+    // may share a cell when moving continuously.
+    ents map[int64]map[UniqueId]*EntityDesc
     // Entity position (or cells) as 3D vectors may be looked up with this
     pos map[UniqueId]*s3dm.V3
+    // Entities by area, for queries
+    index *spatialIndex
+    // Descriptors of all entities with a position
+    descs map[UniqueId]*EntityDesc
+    // Random numbers for spawning, seeded from the ServiceContext
+    rand *rand.Rand
+    // Static terrain, open ground by default. Must be set before Run.
+    Map *Map
+    // If true, entities move continuously and collide by their Collision
+    // radius instead of moving from cell to cell. Must be set before Run.
+    Continuous bool
+    // Collision radius of entities, see radiusOf
+    radius map[UniqueId]float64
+    // Largest distance between attacker and target for AttackMsg. With
+    // Continuous, it is measured between the edges of their circles.
+    AttackRange float64
+    // If true, moving into another entity attacks it, otherwise the move just
+    // stops there
+    BumpAttack bool
+    // Simulated seconds an entity has to wait between attacks, at least one
+    // tick. Applies to AttackMsg and to bump attacks.
+    AttackDelay float64
+    // Number of the tick from which each entity may attack again
+    nextAttack map[UniqueId]uint64
     // Listens on this channel to receive messages
     input chan Msg
 }
 
 func NewWorld(svc ServiceContext) *World {
     hq := NewHandlerQueue()
-    ents := make(map[string]chan Msg)
+    ents := make(map[int64]map[UniqueId]*EntityDesc)
     pos := make(map[UniqueId]*s3dm.V3)
-    return &World{hq, svc, ents, pos, nil}
+    descs := make(map[UniqueId]*EntityDesc)
+    return &World{hq, svc, ents, pos, newSpatialIndex(), descs,
+        svc.NewRand("world"), NewMap(), false, make(map[UniqueId]float64),
+        attackRange, true, attackDelay, make(map[UniqueId]uint64), nil}
 }
 
 func (w *World) Chan() chan Msg { return w.input }
 
 func (w *World) Run(input chan Msg) {
+    w.input = input
     // Subscribe to listen for new entities in order to track their position
     Send(w, w.svc.PubSub, pubsub.SubscribeMsg{"entity", input})
-    Send(w, w.svc.Game, MsgTick{input}) // Service is ready
+    Send(w, w.svc.Game, MsgTick{Origin: input}) // Service is ready
 
     for {
-        w.handle(w.GetMsg(input))
+        msg := w.GetMsg(input)
+        if m, ok := msg.(MsgQuit); ok {
+            AckQuit(w, m)
+            return
+        }
+        w.handle(msg)
     }
 }
 
 func (w *World) handle(msg Msg) {
     switch m := msg.(type) {
+    case AttackMsg:
+        ok := w.attack(m.Attacker, m.Target, m.Strike, m.Tick)
+        if m.Reply != nil {
+            Send(w, m.Reply, ok)
+        }
     case MoveMsg:
-        w.moveEnt(m.Ent, m.Vel)
+        result := w.moveEnt(m.Ent, m.Vel, m.Strike, m.Tick)
+        if m.Reply != nil {
+            Send(w, m.Reply, result)
+        }
     case MsgEntityAdded:
         reply := make(chan Msg)
         Send(w, m.Entity.Chan, MsgGetState{cmpId.Position, reply})
         if pos, ok := Recv(w, reply).(Position); ok {
+            Send(w, m.Entity.Chan, MsgGetState{cmpId.Collision, reply})
+            if c, ok := Recv(w, reply).(Collision); ok {
+                w.radius[m.Entity.Uid] = c.Radius
+            }
             w.putInEmptyPos(m.Entity, pos.Position)
         }
     case MsgEntityRemoved:
-        pos := w.pos[m.Entity.Uid]
+        pos, ok := w.pos[m.Entity.Uid]
+        if !ok {
+            return // Never had a position
+        }
         w.pos[m.Entity.Uid] = nil, false
-        w.ents[hashV3(pos)] = nil, false
+        w.descs[m.Entity.Uid] = nil, false
+        w.radius[m.Entity.Uid] = 0, false
+        w.nextAttack[m.Entity.Uid] = 0, false
+        w.index.remove(m.Entity.Uid, pos)
+        w.leaveCell(m.Entity, pos)
+    case MsgEntitiesInRadius:
+        list := w.entitiesInRadius(m.Uid, m.Radius)
+        Send(w, m.Reply, MsgListEntities{nil, list})
+    case MsgEntitiesInRect:
+        list := w.entitiesInRect(m.MinX, m.MinY, m.MaxX, m.MaxY)
+        Send(w, m.Reply, MsgListEntities{nil, list})
+    case MsgNearestEntity:
+        Send(w, m.Reply, w.nearestEntity(m.Uid, m.Id, m.MaxDist))
+    case MsgLineOfSight:
+        from, to := &s3dm.V3{m.FromX, m.FromY, 0}, &s3dm.V3{m.ToX, m.ToY, 0}
+        Send(w, m.Reply, w.canSee(from, to))
+    case MsgFieldOfView:
+        x, y := cellOf(&s3dm.V3{m.X, m.Y, 0})
+        Send(w, m.Reply, MsgVisibleCells{w.fieldOfView(x, y, m.Radius)})
+    case MsgVisibleEntities:
+        list := w.visibleEntities(m.Uid, m.Radius)
+        Send(w, m.Reply, MsgListEntities{nil, list})
+    case PathMsg:
+        Send(w, m.Reply, w.findPath(m))
+    case GetPosMsg:
+        var pos *s3dm.V3
+        if p, ok := w.pos[m.Uid]; ok {
+            pos = p.Copy()
+        }
+        Send(w, m.Reply, pos)
+    case MsgTick: // Deterministic mode, all moves so far are done
+        Send(w, m.Origin, MsgTick{Origin: w.input})
+    }
+}
+
+// Returns all entities within radius of the entity uid, measured in the XY
+// plane and sorted by uid. The list is empty if uid has no position.
+func (w *World) entitiesInRadius(uid UniqueId, radius float64) []*EntityDesc {
+    center, ok := w.pos[uid]
+    if !ok {
+        return nil
+    }
+    list := make([]*EntityDesc, 0, 8)
+    for _, other := range w.around(center, radius) {
+        if distSq(w.pos[other], center) <= radius*radius {
+            list = append(list, w.descs[other])
+        }
+    }
+    return list
+}
+
+// Returns all entities in the rectangle, sorted by uid.
+func (w *World) entitiesInRect(minX, minY, maxX, maxY float64) []*EntityDesc {
+    list := make([]*EntityDesc, 0, 8)
+    for _, uid := range w.index.candidates(minX, minY, maxX, maxY) {
+        pos := w.pos[uid]
+        if pos.X >= minX && pos.X <= maxX && pos.Y >= minY && pos.Y <= maxY {
+            list = append(list, w.descs[uid])
+        }
     }
+    return list
 }
 
-// Puts the passed entity in an empty position as close to pos as possible.
+// Returns the entity of type id closest to the entity uid, or nil. Of equally
+// close entities the one with the lowest uid wins.
+func (w *World) nearestEntity(uid UniqueId, id EntityId, maxDist float64) *EntityDesc {
+    center, ok := w.pos[uid]
+    if !ok {
+        return nil
+    }
+    var candidates []UniqueId
+    if maxDist > 0 {
+        candidates = w.around(center, maxDist)
+    } else {
+        candidates = w.index.candidates(math.Inf(-1), math.Inf(-1),
+            math.Inf(1), math.Inf(1))
+    }
+    var nearest *EntityDesc
+    best := maxDist * maxDist
+    for _, other := range candidates {
+        desc := w.descs[other]
+        if other == uid || desc.Id != id {
+            continue
+        }
+        d := distSq(w.pos[other], center)
+        if (maxDist <= 0 || d <= best) && (nearest == nil || d < best) {
+            nearest, best = desc, d
+        }
+    }
+    return nearest
+}
+
+// Returns the entities in the square around center that holds the circle of
+// radius, sorted by uid.
+func (w *World) around(center *s3dm.V3, radius float64) []UniqueId {
+    return w.index.candidates(center.X-radius, center.Y-radius,
+        center.X+radius, center.Y+radius)
+}
+
+// Squared distance between a and b in the XY plane
+func distSq(a, b *s3dm.V3) float64 {
+    dx, dy := a.X-b.X, a.Y-b.Y
+    return dx*dx + dy*dy
+}
+
+// Puts the passed entity in an empty, passable position as close to pos as
+// possible.
 // TODO: Current implementation doesn't try very hard at closeness ;)
 func (w *World) putInEmptyPos(ent *EntityDesc, pos *s3dm.V3) {
     old_pos := pos.Copy()
     for {
-        if _, ok := w.ents[hashV3(pos)]; !ok {
+        if w.occupant(keyOf(pos), ent.Uid) == nil && w.Map.Passable(pos) {
             break // Empty, proceed
         }
         inc := &s3dm.V3{1, 1, 0}
@@ -101,43 +275,149 @@ func (w *World) putInEmptyPos(ent *EntityDesc, pos *s3dm.V3) {
 // is passed.
 func (w *World) setPos(ent *EntityDesc, new_pos, old_pos *s3dm.V3) {
     if old_pos != nil {
-        w.ents[hashV3(old_pos)] = nil, false // Remove old pos
+        w.leaveCell(ent, old_pos) // Remove old pos
+        w.index.move(ent.Uid, old_pos, new_pos)
+    } else {
+        w.index.insert(ent.Uid, new_pos)
+    }
+    key := keyOf(new_pos)
+    cell, ok := w.ents[key]
+    if !ok {
+        cell = make(map[UniqueId]*EntityDesc)
+        w.ents[key] = cell
     }
-    w.ents[hashV3(new_pos)] = ent.Chan
+    cell[ent.Uid] = ent
     w.pos[ent.Uid] = new_pos
+    w.descs[ent.Uid] = ent
 }
 
-func (w *World) moveEnt(ent *EntityDesc, vel *s3dm.V3) {
+// Takes the entity out of the cell of pos, other entities in it stay.
+func (w *World) leaveCell(ent *EntityDesc, pos *s3dm.V3) {
+    key := keyOf(pos)
+    if cell, ok := w.ents[key]; ok {
+        cell[ent.Uid] = nil, false
+        if len(cell) == 0 {
+            w.ents[key] = nil, false
+        }
+    }
+}
+
+// Returns the entity in the cell key with the lowest uid other than uid, nil
+// if there is none.
+func (w *World) occupant(key int64, uid UniqueId) *EntityDesc {
+    var found *EntityDesc
+    for other, desc := range w.ents[key] {
+        if other != uid && (found == nil || other < found.Uid) {
+            found = desc
+        }
+    }
+    return found
+}
+
+// Moves an entity by vel, cell by cell or continuously, see Continuous.
+// Running into another entity attacks it with strike if BumpAttack is set and
+// the entity may attack at tick.
+func (w *World) moveEnt(ent *EntityDesc, vel *s3dm.V3, strike Strike,
+tick MsgTick) MoveResultMsg {
     // Compute new position vector
     old_pos, ok := w.pos[ent.Uid]
     if !ok { // Entity hasn't been added for some reason, bail
         log.Println("No position for", ent.Uid)
-        return
-    }
-    new_pos := old_pos.Add(vel)
-    hash := hashV3(new_pos)
-
-    // See if destination cell is occupied
-    if ent_ch, ok := w.ents[hash]; ok {
-        // TODO: HACK remove following if block when spider AI uses time based move
-        // Update position if movement is less than 1, this lets spider move slowly
-        if math.Fabs(vel.X) < 1 && math.Fabs(vel.Y) < 1 {
-            w.pos[ent.Uid] = new_pos
-            Send(w, ent.Chan, MsgSetState{Position{new_pos}})
-        }
+        return MoveResultMsg{nil, nil, true}
+    }
+    var result MoveResultMsg
+    if w.Continuous {
+        result = w.sweep(ent, old_pos, vel)
+    } else {
+        result = w.moveToCell(ent, old_pos, vel)
+    }
+    if result.Contact != nil && w.BumpAttack && w.attackReady(ent.Uid, tick) {
         // Can't move there, attack instead
-        Send(w, ent_ch, MsgRunAction{Attack{ent}, false})
-        return
+        Send(w, result.Contact.Chan, MsgRunAction{Attack{ent, strike}, false})
+    }
+    if result.Pos.Equals(old_pos) {
+        result.Pos = old_pos.Copy()
+        return result
     }
-    // If not, move the entity to the new pos
-    w.setPos(ent, new_pos, old_pos)
+    // Move the entity to the new pos
+    w.setPos(ent, result.Pos, old_pos)
     // Update entity position state
-    Send(w, ent.Chan, MsgSetState{Position{new_pos}})
+    Send(w, ent.Chan, MsgSetState{Position{result.Pos}})
 
     // Spawn spiders as players move around
     if ent.Id == cmpId.Player {
-        w.spawnSpiders(new_pos)
+        w.spawnSpiders(result.Pos)
+    }
+    return MoveResultMsg{result.Pos.Copy(), result.Contact, result.Blocked}
+}
+
+// Moves toward the cell at old_pos + vel one cell at a time, stopping in the
+// last cell before the terrain or another entity is in the way. Moves longer
+// than maxSteps cells are cut short.
+func (w *World) moveToCell(ent *EntityDesc, old_pos, vel *s3dm.V3) MoveResultMsg {
+    // Enough steps not to skip a cell, diagonals count as one
+    length := math.Fmax(math.Fabs(vel.X), math.Fabs(vel.Y))
+    if math.IsNaN(length) || math.IsInf(length, 0) {
+        return MoveResultMsg{old_pos, nil, true}
+    }
+    blocked := false
+    if length > maxSteps {
+        f := maxSteps / length
+        vel = &s3dm.V3{vel.X * f, vel.Y * f, vel.Z * f}
+        length, blocked = maxSteps, true
+    }
+    steps := int(math.Ceil(length))
+
+    pos := old_pos
+    for i := 1; i <= steps; i++ {
+        f := float64(i) / float64(steps)
+        next := &s3dm.V3{old_pos.X + vel.X*f, old_pos.Y + vel.Y*f,
+            old_pos.Z + vel.Z*f}
+        // Walls, trees and the like can't be entered
+        if !w.Map.Passable(next) {
+            return MoveResultMsg{pos, nil, true}
+        }
+        // See if the cell is occupied
+        if other := w.occupant(keyOf(next), ent.Uid); other != nil {
+            return MoveResultMsg{pos, other, true}
+        }
+        pos = next
+    }
+    return MoveResultMsg{old_pos.Add(vel), nil, blocked}
+}
+
+// Lets attacker attack the entity target if it is within range and attacker
+// may attack at tick. Returns whether it did.
+func (w *World) attack(attacker *EntityDesc, target UniqueId, strike Strike,
+tick MsgTick) bool {
+    from, ok := w.pos[attacker.Uid]
+    to, ok2 := w.pos[target]
+    if !ok || !ok2 || attacker.Uid == target {
+        return false
+    }
+    reach := w.AttackRange
+    if w.Continuous {
+        reach += w.radiusOf(attacker.Uid) + w.radiusOf(target)
+    }
+    if distSq(from, to) > reach*reach || !w.attackReady(attacker.Uid, tick) {
+        return false
+    }
+    Send(w, w.descs[target].Chan, MsgRunAction{Attack{attacker, strike}, false})
+    return true
+}
+
+// Whether the entity uid is done waiting for its next attack at tick. If it
+// is, it has to wait AttackDelay again.
+func (w *World) attackReady(uid UniqueId, tick MsgTick) bool {
+    if tick.Tick < w.nextAttack[uid] {
+        return false
+    }
+    wait := uint64(1)
+    if tick.Dt > 0 && w.AttackDelay/tick.Dt > 1 {
+        wait = uint64(math.Ceil(w.AttackDelay / tick.Dt))
     }
+    w.nextAttack[uid] = tick.Tick + wait
+    return true
 }
 
 func (w *World) spawnSpiders(pos *s3dm.V3) {
@@ -160,7 +440,7 @@ func (w *World) spawnSpiders(pos *s3dm.V3) {
         count++
     }
     // Random chance for a spider to spawn
-    if rand.Float64() <= dist/LEVEL_DIST {
+    if w.rand.Float64() <= dist/LEVEL_DIST {
         count++
     }
 
@@ -168,13 +448,13 @@ func (w *World) spawnSpiders(pos *s3dm.V3) {
     // between MIN_DIST and MAX_DIST.
     reply := make(chan Msg)
     for i := 0; i < count; i++ {
-        radius := rand.Float64()*(MAX_DIST-MIN_DIST) + MIN_DIST
-        angle := rand.Float64() * 2. * math.Pi
+        radius := w.rand.Float64()*(MAX_DIST-MIN_DIST) + MIN_DIST
+        angle := w.rand.Float64() * 2. * math.Pi
         x := pos.X + radius*math.Cos(angle)
         y := pos.Y + radius*math.Sin(angle)
-        // Create the spider entity and position it
-        Send(w, w.svc.Game, game.MsgSpawnEntity{InitSpider, reply})
-        spider := Recv(w, reply).(*EntityDesc)
-        Send(w, spider.Chan, MsgSetState{Position{s3dm.NewV3(x, y, 0.)}})
+        // Create the spider entity at its position
+        overrides := []State{Position{s3dm.NewV3(x, y, 0.)}}
+        Send(w, w.svc.Game, game.MsgSpawnTemplate{"Spider", overrides, reply})
+        Recv(w, reply)
     }
 }
@@ -0,0 +1,110 @@
+// Copyright 2011 The ghack Authors. All rights reserved.
+// Use of this source code is governed by the GNU General Public License
+// version 3 (or any later version). See the file COPYING for details.
+
+package sf
+
+import (
+    "fmt"
+    "reflect"
+    "testing"
+    "github.com/tm1rbrt/s3dm"
+    .   "core"
+)
+
+// Uids of the entities in the attack tests
+const (
+    attacker = 1
+    target   = 2
+)
+
+var attackTests = []struct {
+    name       string
+    continuous bool
+    radius     float64  // Collision radius of the target, 0 for the default
+    pos        *s3dm.V3 // Position of the target, the attacker is at the origin
+    target     UniqueId
+    ok         bool
+}{
+    {"next to", false, 0, &s3dm.V3{1, 0, 0}, target, true},
+    {"diagonal", false, 0, &s3dm.V3{1, 1, 0}, target, true},
+    {"out of range", false, 0, &s3dm.V3{2, 0, 0}, target, false},
+    {"radius ignored in cells", false, 2, &s3dm.V3{2, 0, 0}, target, false},
+    // Reach is 1.5 plus both radii
+    {"edges in range", true, 0, &s3dm.V3{2.2, 0, 0}, target, true},
+    {"edges out of range", true, 0, &s3dm.V3{2.4, 0, 0}, target, false},
+    {"big target", true, 2, &s3dm.V3{3.8, 0, 0}, target, true},
+    {"big target out of range", true, 2, &s3dm.V3{4, 0, 0}, target, false},
+    {"itself", false, 0, &s3dm.V3{1, 0, 0}, attacker, false},
+    {"not in world", false, 0, &s3dm.V3{1, 0, 0}, target + 1, false},
+}
+
+func TestAttack(t *testing.T) {
+    strike := Strike{1, Damage{1, 2, Physical}}
+    for _, test := range attackTests {
+        w := NewWorld(NewServiceContext())
+        w.Continuous = test.continuous
+        from := &EntityDesc{make(chan Msg, 1), attacker, 0, "Attacker"}
+        to := &EntityDesc{make(chan Msg, 1), target, 0, "Target"}
+        w.setPos(from, &s3dm.V3{0, 0, 0}, nil)
+        w.setPos(to, test.pos, nil)
+        if test.radius > 0 {
+            w.radius[target] = test.radius
+        }
+
+        ok := w.attack(from, test.target, strike, MsgTick{Tick: 1, Dt: 0.1})
+        if ok != test.ok {
+            t.Errorf("%s: attacked %v, expected %v", test.name, ok, test.ok)
+        }
+        var got Msg
+        select {
+        case got = <-to.Chan:
+        case got = <-from.Chan:
+        default:
+        }
+        switch m, sent := got.(MsgRunAction); {
+        case test.ok && !sent:
+            t.Errorf("%s: target not told about the attack", test.name)
+        case !test.ok && got != nil:
+            t.Errorf("%s: sent %v without an attack", test.name, got)
+        case test.ok && !reflect.DeepEqual(m.Action, Attack{from, strike}):
+            t.Errorf("%s: ran %v, expected the attack", test.name, m.Action)
+        }
+    }
+}
+
+var attackDelayTests = []struct {
+    name  string
+    delay float64 // AttackDelay of the world
+    dt    float64 // Dt of every tick
+    ticks []uint64
+    ready string // Expected attackReady for each tick
+}{
+    {"no delay", 0, 0.1, []uint64{1, 1, 2, 3}, "[true false true true]"},
+    {"no dt", 0.5, 0, []uint64{1, 1, 2}, "[true false true]"},
+    {"five ticks", 0.5, 0.1, []uint64{1, 2, 5, 6, 10, 11},
+        "[true false false true false true]"},
+    {"faster time", 0.5, 0.2, []uint64{1, 3, 4, 6, 7},
+        "[true false true false true]"},
+    {"slow ticks", 0.5, 1, []uint64{1, 2, 3}, "[true true true]"},
+}
+
+// The cooldown is counted in ticks from the simulated time each one covers
+func TestAttackDelay(t *testing.T) {
+    for _, test := range attackDelayTests {
+        w := NewWorld(NewServiceContext())
+        w.AttackDelay = test.delay
+        ready := make([]bool, len(test.ticks))
+        for i, tick := range test.ticks {
+            ready[i] = w.attackReady(attacker, MsgTick{Tick: tick, Dt: test.dt})
+        }
+        if fmt.Sprint(ready) != test.ready {
+            t.Errorf("%s: ready %v at ticks %v, expected %s", test.name, ready,
+                test.ticks, test.ready)
+        }
+        // Others keep their own cooldown
+        if !w.attackReady(target, MsgTick{Tick: test.ticks[0], Dt: test.dt}) {
+            t.Errorf("%s: another entity has to wait", test.name)
+        }
+    }
+}
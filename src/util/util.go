@@ -26,7 +26,7 @@ func DrainUntilQuit(ch chan Msg) {
 }
 
 // Variable length buffer for the passed channel. Returns a channel for input.
-// TODO: Write test to ensure that this function always does the right thing
+// Messages come out on ch in the order they went in, none are lost.
 func MsgBuffer(ch chan Msg) chan Msg {
     in := make(chan Msg)
     go func() {
@@ -35,20 +35,20 @@ func MsgBuffer(ch chan Msg) chan Msg {
         var out chan Msg // Start as nil so we don't send
 
         // Alternate between receiving from in and sending on out. Each
-        // received message gets appended onto buf and then the first value is
-        // popped off and sent.
+        // received message gets appended onto buf, the first value is only
+        // popped off once it has been sent.
         for {
             if len(buf) == 0 {
                 out = nil // Disable send
             } else {
-                out = ch              // Enable send
-                msg = buf[0]          // Set value to send
-                buf = buf[1:len(buf)] // Discard the value
+                out = ch     // Enable send
+                msg = buf[0] // Set value to send
             }
             select {
             case next := <-in: // Read next message
                 buf = append(buf, next) // Save in queue
             case out <- msg: // Send message, if enabled
+                buf = buf[1:len(buf)] // Discard the value
             }
         }
     }()